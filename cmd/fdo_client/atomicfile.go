@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at path with what write writes and sets
+// its mode. The data is written to a temp file in the same dir, synced and
+// renamed over path, so that a crash leaves either the old or the new file.
+// Errors of write are returned as is.
+func writeFileAtomic(path string, mode os.FileMode, write func(io.Writer) error) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp_*")
+	if err != nil {
+		return fmt.Errorf("error creating temp file for %q: %w", path, err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if err := tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("error setting mode of temp file for %q: %w", path, err)
+	}
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("error syncing temp file for %q: %w", path, err)
+	}
+
+	// Ensure the temp file is closed before renaming
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temp file for %q: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error renaming temp file to %q: %w", path, err)
+	}
+
+	// Sync the dir so that the rename survives a crash
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
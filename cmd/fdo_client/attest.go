@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/fido-device-onboard/go-fdo-client/internal/tpm_utils"
+)
+
+// ekCertHeader carries the base64 encoded DER EK certificate of the TPM on
+// every DI request when -di-attest is set. DeviceMfgInfo has no field for it,
+// so a DI server which requires attestation must read this header and verify
+// the certificate against the TPM manufacturer CAs before issuing a voucher.
+const ekCertHeader = "FDO-TPM-EK-Certificate"
+
+// diHeaders returns the HTTP headers to send with DI requests.
+func diHeaders() (http.Header, error) {
+	if !diAttest {
+		return nil, nil
+	}
+	der, err := tpm_utils.TpmReadEKCert(tpmc)
+	if err != nil {
+		return nil, fmt.Errorf("error reading TPM EK certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing TPM EK certificate: %w", err)
+	}
+	slog.Debug("Attesting with TPM EK certificate", "issuer", cert.Issuer.String(), "serial", cert.SerialNumber)
+	return http.Header{ekCertHeader: {base64.StdEncoding.EncodeToString(der)}}, nil
+}
@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted blobs are laid out as magic || salt || nonce || ciphertext, where
+// the ciphertext is the AES-256-GCM sealed CBOR credential with the magic
+// header as additional data. The key is derived from the passphrase or key
+// file contents using scrypt.
+var encryptedBlobMagic = []byte("FDOENC1\x00")
+
+const (
+	blobSaltSize  = 16
+	blobNonceSize = 12
+)
+
+// blobEncrypted is set when the credential read from blobPath was encrypted,
+// so that updates remain encrypted even without -blob-encrypt.
+var blobEncrypted bool
+
+// isEncryptedBlob reports whether data has the encrypted blob header.
+func isEncryptedBlob(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedBlobMagic)
+}
+
+// blobSecret returns the secret from -blob-keyfile or -blob-pass.
+func blobSecret() ([]byte, error) {
+	if blobKeyFile != "" {
+		secret, err := os.ReadFile(filepath.Clean(blobKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("error reading blob key file %q: %w", blobKeyFile, err)
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("blob key file %q is empty", blobKeyFile)
+		}
+		return secret, nil
+	}
+	if blobPass != "" {
+		return []byte(blobPass), nil
+	}
+	return nil, fmt.Errorf("encrypted blob credential requires -blob-pass or -blob-keyfile")
+}
+
+func blobAEAD(salt []byte) (cipher.AEAD, error) {
+	secret, err := blobSecret()
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(secret, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving blob encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptBlob seals a CBOR-encoded credential.
+func encryptBlob(plaintext []byte) ([]byte, error) {
+	salt := make([]byte, blobSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating blob encryption salt: %w", err)
+	}
+	aead, err := blobAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, blobNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating blob encryption nonce: %w", err)
+	}
+
+	out := append(bytes.Clone(encryptedBlobMagic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, encryptedBlobMagic), nil
+}
+
+// decryptBlob opens a credential sealed by encryptBlob.
+func decryptBlob(data []byte) ([]byte, error) {
+	data = data[len(encryptedBlobMagic):]
+	if len(data) < blobSaltSize+blobNonceSize {
+		return nil, fmt.Errorf("encrypted blob credential is truncated")
+	}
+	salt, nonce, ciphertext := data[:blobSaltSize], data[blobSaltSize:blobSaltSize+blobNonceSize], data[blobSaltSize+blobNonceSize:]
+	aead, err := blobAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, encryptedBlobMagic)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting blob credential (wrong passphrase or key file?): %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/blob"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+func testBlobCred(t *testing.T) fdoDeviceCredential {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fdoDeviceCredential{
+		DC: blob.DeviceCredential{
+			Active: true,
+			DeviceCredential: fdo.DeviceCredential{
+				Version:    101,
+				DeviceInfo: "test-device",
+				GUID:       protocol.GUID{1, 2, 3},
+			},
+			HmacSecret: []byte("hmac-secret"),
+			PrivateKey: blob.Pkcs8Key{Signer: key},
+		},
+		State: FDO_STATE_PRE_TO1,
+	}
+}
+
+// withBlobGlobals restores the blob flags and the state recorded by
+// readCredFile after the test.
+func withBlobGlobals(t *testing.T) {
+	t.Helper()
+	path, pass, keyFile := blobPath, blobPass, blobKeyFile
+	encrypt, encrypted := blobEncrypt, blobEncrypted
+	compress, compressed := blobCompress, blobCompressed
+	t.Cleanup(func() {
+		blobPath, blobPass, blobKeyFile = path, pass, keyFile
+		blobEncrypt, blobEncrypted = encrypt, encrypted
+		blobCompress, blobCompressed = compress, compressed
+	})
+	blobPath = filepath.Join(t.TempDir(), "cred.bin")
+	blobPass, blobKeyFile = "", ""
+	blobEncrypt, blobEncrypted = false, false
+	blobCompress, blobCompressed = false, false
+}
+
+func TestEncryptBlobRoundTrip(t *testing.T) {
+	withBlobGlobals(t)
+	keyFile := filepath.Join(t.TempDir(), "blob.key")
+	if err := os.WriteFile(keyFile, []byte("key file secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("credential")
+
+	for _, test := range []struct {
+		name          string
+		pass, keyFile string
+	}{
+		{name: "passphrase", pass: "correct horse"},
+		{name: "key file", keyFile: keyFile},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			blobPass, blobKeyFile = test.pass, test.keyFile
+			sealed, err := encryptBlob(plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isEncryptedBlob(sealed) {
+				t.Fatal("sealed blob is missing the encrypted blob header")
+			}
+			if bytes.Contains(sealed, plaintext) {
+				t.Fatal("sealed blob contains the plaintext")
+			}
+			opened, err := decryptBlob(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Errorf("expected %q, got %q", plaintext, opened)
+			}
+
+			blobPass, blobKeyFile = "wrong", ""
+			if _, err := decryptBlob(sealed); err == nil {
+				t.Error("expected decryption with the wrong secret to fail")
+			}
+		})
+	}
+}
+
+func TestEncryptedCredRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		name := "uncompressed"
+		if compress {
+			name = "compressed"
+		}
+		t.Run(name, func(t *testing.T) {
+			withBlobGlobals(t)
+			blobPass, blobEncrypt, blobCompress = "correct horse", true, compress
+
+			want := testBlobCred(t)
+			if err := saveCred(want); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(blobPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isEncryptedBlob(data) {
+				t.Fatal("saved credential is not encrypted")
+			}
+
+			// Reading without -blob-encrypt must still decrypt and keep
+			// later updates encrypted
+			blobEncrypt, blobCompress = false, false
+			var got fdoDeviceCredential
+			if err := readCredFile(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !blobEncrypted {
+				t.Error("blobEncrypted not set after reading an encrypted credential")
+			}
+			if blobCompressed != compress {
+				t.Errorf("expected blobCompressed %t, got %t", compress, blobCompressed)
+			}
+			if got.DC.GUID != want.DC.GUID || got.DC.DeviceInfo != want.DC.DeviceInfo ||
+				!bytes.Equal(got.DC.HmacSecret, want.DC.HmacSecret) || got.State != want.State {
+				t.Errorf("credential changed in round trip: expected %+v, got %+v", want, got)
+			}
+
+			blobPass = "wrong"
+			if err := readCredFile(&got); err == nil {
+				t.Error("expected reading with the wrong passphrase to fail")
+			}
+		})
+	}
+}
+
+func TestPlaintextCredStillLoads(t *testing.T) {
+	withBlobGlobals(t)
+
+	want := testBlobCred(t)
+	if err := saveCred(want); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(blobPath); err != nil {
+		t.Fatal(err)
+	} else if isEncryptedBlob(data) {
+		t.Fatal("credential encrypted without -blob-encrypt")
+	}
+
+	// A passphrase given for a plaintext credential is not required to match
+	blobPass = "unused"
+	var got fdoDeviceCredential
+	if err := readCredFile(&got); err != nil {
+		t.Fatal(err)
+	}
+	if blobEncrypted {
+		t.Error("blobEncrypted set after reading a plaintext credential")
+	}
+	if got.DC.GUID != want.DC.GUID {
+		t.Errorf("expected GUID %x, got %x", want.DC.GUID, got.DC.GUID)
+	}
+}
@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipMagic starts every gzip stream. A CBOR credential never starts with it,
+// as 0x1f is not a valid initial byte of a CBOR array.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maxBlobSize limits the decompressed size of a credential blob, so that a
+// corrupt or hostile blob cannot exhaust memory.
+const maxBlobSize = 1 << 20
+
+// blobCompressed is set when the credential read from blobPath was
+// compressed, so that updates remain compressed even without -blob-compress.
+var blobCompressed bool
+
+// isCompressedBlob reports whether data is gzip compressed.
+func isCompressedBlob(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic)
+}
+
+// compressBlob gzips a CBOR-encoded credential. It is applied before
+// encryption, as encrypted data does not compress.
+func compressBlob(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("error compressing blob credential: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing blob credential: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBlob reverses compressBlob.
+func decompressBlob(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing blob credential: %w", err)
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, maxBlobSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing blob credential: %w", err)
+	}
+	if len(out) > maxBlobSize {
+		return nil, fmt.Errorf("decompressed blob credential is larger than %d bytes", maxBlobSize)
+	}
+	return out, nil
+}
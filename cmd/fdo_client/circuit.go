@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// ownerCircuit tracks Owner URL failures for the life of the process. Every
+// Owner URL is tried at most once per run, so the breaker is kept across the
+// runs of -watch and the devices of multiple -blob values, which skip an Owner
+// URL that failed in earlier runs.
+var ownerCircuit *circuitBreaker
+
+// circuitBreaker skips URLs which have failed repeatedly. After threshold
+// consecutive failures a URL is skipped for the cooldown period, which doubles
+// each time the breaker trips again. A success resets the URL's state. A zero
+// threshold disables the breaker.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	urls      map[string]*circuitState
+}
+
+type circuitState struct {
+	failures  int
+	trips     int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		urls:      make(map[string]*circuitState),
+	}
+}
+
+// Allow reports whether the URL may be attempted.
+func (cb *circuitBreaker) Allow(url string) bool {
+	if cb.threshold <= 0 {
+		return true
+	}
+	state, ok := cb.urls[url]
+	if !ok || time.Now().After(state.openUntil) {
+		return true
+	}
+	slog.Debug("Skipping URL with open circuit", "url", url, "until", state.openUntil)
+	return false
+}
+
+// Success resets the failure state of the URL.
+func (cb *circuitBreaker) Success(url string) {
+	delete(cb.urls, url)
+}
+
+// Failure records a failed attempt and opens the circuit once the threshold
+// of consecutive failures is reached.
+func (cb *circuitBreaker) Failure(url string) {
+	if cb.threshold <= 0 {
+		return
+	}
+	state, ok := cb.urls[url]
+	if !ok {
+		state = new(circuitState)
+		cb.urls[url] = state
+	}
+	state.failures++
+	if state.failures < cb.threshold {
+		return
+	}
+	cooldown := cb.cooldown << min(state.trips, 16)
+	state.failures = 0
+	state.trips++
+	state.openUntil = time.Now().Add(cooldown)
+	slog.Warn("Too many consecutive failures, skipping URL", "url", url, "cooldown", cooldown)
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker(2, 50*time.Millisecond)
+	const url = "http://owner.example.com"
+
+	cb.Failure(url)
+	if !cb.Allow(url) {
+		t.Fatal("URL skipped before reaching the threshold")
+	}
+	cb.Failure(url)
+	if cb.Allow(url) {
+		t.Fatal("URL not skipped after reaching the threshold")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !cb.Allow(url) {
+		t.Fatal("URL still skipped after the cooldown")
+	}
+
+	// The cooldown doubles on the next trip and a success resets it
+	cb.Failure(url)
+	cb.Failure(url)
+	time.Sleep(60 * time.Millisecond)
+	if cb.Allow(url) {
+		t.Fatal("second trip did not double the cooldown")
+	}
+	cb.Success(url)
+	if !cb.Allow(url) {
+		t.Fatal("success did not reset the URL")
+	}
+
+	disabled := newCircuitBreaker(0, time.Minute)
+	for range 10 {
+		disabled.Failure(url)
+	}
+	if !disabled.Allow(url) {
+		t.Fatal("disabled breaker skipped a URL")
+	}
+}
+
+func TestCircuitBreakerSkipsOwnerInLaterRun(t *testing.T) {
+	defer func(threshold int, cooldown time.Duration, cb *circuitBreaker) {
+		circuitMax, circuitWait, ownerCircuit = threshold, cooldown, cb
+	}(circuitMax, circuitWait, ownerCircuit)
+	circuitMax, circuitWait, ownerCircuit = 1, time.Minute, nil
+
+	var hellos atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/msg/60") {
+			hellos.Add(1)
+		}
+		http.Error(w, "owner unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	rvInfo, err := parseRvInfo([]byte("protocol=http ip=127.0.0.1 port=" + testPort(t, srv.URL) + " bypass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each run of -watch or device of a -blob dir starts with resetRun
+	for run := 1; run <= 2; run++ {
+		resetRun()
+		if _, err := transferOwnership(context.Background(), rvInfo, testTO2Config(t)); !errors.Is(err, errTO2Failed) {
+			t.Fatalf("run %d: expected TO2 to fail, got %v", run, err)
+		}
+	}
+	if n := hellos.Load(); n != 1 {
+		t.Errorf("expected the failed Owner URL to be skipped by the second run, got %d TO2 attempts", n)
+	}
+	if n := onboardMetrics.To2Attempts; n != 0 {
+		t.Errorf("expected no TO2 attempt in the second run, got %d", n)
+	}
+}
@@ -13,19 +13,24 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/sha512"
+	cryptotls "crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
 	"log/slog"
 	"math"
 	"math/big"
+	mathrand "math/rand/v2"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -47,24 +52,108 @@ import (
 var clientFlags = flag.NewFlagSet("client", flag.ContinueOnError)
 
 var (
-	debug        bool
-	blobPath     string
-	diURL        string
-	diKey        string
-	diKeyEnc     string
-	kexSuite     string
-	cipherSuite  string
-	tpmPath      string
-	printDevice  bool
-	rvOnly       bool
-	dlDir        string
-	echoCmds     bool
-	uploads      = make(fsVar)
-	wgetDir      string
-	deviceStatus FdoDeviceState
-	insecureTLS  bool
-	tpmc         tpm.Closer
-	resale       bool
+	debug            bool
+	logFormat        string
+	logLevel         string
+	blobPath         string
+	blobEncrypt      bool
+	blobCompress     bool
+	blobPass         string
+	blobKeyFile      string
+	diURL            string
+	diKey            string
+	diKeyType        string
+	diKeyCurve       string
+	diKeySize        int
+	diKeyEnc         string
+	kexSuite         string
+	cipherSuite      string
+	tpmPath          string
+	skipNVVerify     bool
+	pkcs11Module     string
+	pkcs11Slot       int
+	pkcs11Pin        string
+	pkcs11PinFile    string
+	printDevice      bool
+	printDevmodOnly  bool
+	devmodOS         string
+	devmodArch       string
+	showSecrets      bool
+	rvOnly           bool
+	to1Only          bool
+	to2Only          bool
+	to1BlobPath      string
+	dumpTo1d         bool
+	dumpVoucher      string
+	to1Retries       int
+	to1RetryDelay    time.Duration
+	dlDir            string
+	isolateDir       string
+	outputDir        string
+	createDirs       bool
+	createDirMode    string
+	dlMode           string
+	dlOwner          string
+	echoCmds         bool
+	echoCmdsFile     string
+	uploads          = make(fsVar)
+	uploadCompress   bool
+	ownerHeaders     = make(headersVar)
+	wgetDir          string
+	wgetCA           string
+	wgetAllowHosts   hostsVar
+	skipFsims        modulesVar
+	wgetInsecureTLS  bool
+	wgetChecksumReq  bool
+	maxOVEntries     int
+	to2Concurrency   int
+	tlsSessionCache  bool
+	rateLimit        int64
+	keyFile          string
+	hmacFile         string
+	postDlExec       string
+	circuitMax       int
+	circuitWait      time.Duration
+	metricsFile      string
+	reportFile       string
+	livenessFile     string
+	livenessInterval time.Duration
+	deadline         time.Duration
+	diRetries        int
+	diRetryDelay     time.Duration
+	diSerial         string
+	diManifestPath   string
+	diDeviceInfo     string
+	diModel          string
+	diFirmware       string
+	diAttest         bool
+	diRvInfo         string
+	rvInfoPath       string
+	rvInfoOverride   [][]protocol.RvInstruction
+	deviceStatus     FdoDeviceState
+	insecureTLS      bool
+	skipCertTime     bool
+	hmacHash         string
+	sourceAddr       string
+	dnsServer        string
+	dnsTimeout       time.Duration
+	probeOwners      bool
+	shuffleURLs      bool
+	pinOwnerIP       bool
+	socks5Proxy      string
+	ownerSNI         string
+	failOnFSIMErr    bool
+	retryOn          string
+	statusAddr       string
+	expectGUID       string
+	onboardAfterDI   bool
+	progressInterval time.Duration
+	tpmc             tpm.Closer
+	resale           bool
+	expectReuse      string
+	watch            bool
+	requireOnboard   bool
+	saveVoucher      string
 )
 
 type fsVar map[string]string
@@ -142,33 +231,153 @@ func (files fsVar) Open(path string) (fs.File, error) {
 }
 
 func init() {
-	clientFlags.StringVar(&blobPath, "blob", "cred.bin", "File path of device credential blob")
+	clientFlags.Var(&blobPaths, "blob", "File `path` of device credential blob, or a dir of *.bin blobs; "+
+		"may be provided multiple times to onboard several devices")
+	clientFlags.IntVar(&circuitMax, "circuit-threshold", 0, "Consecutive failed runs before an Owner URL is skipped for a cooldown by later runs of -watch or multiple -blob (0 disables)")
+	clientFlags.DurationVar(&circuitWait, "circuit-cooldown", time.Minute, "Initial `duration` to skip a failing Owner URL, doubled on each further trip")
+	clientFlags.BoolVar(&blobCompress, "blob-compress", false, "Gzip the device credential blob, before encrypting it with -blob-encrypt")
+	clientFlags.BoolVar(&blobEncrypt, "blob-encrypt", false, "Encrypt the device credential blob with -blob-pass or -blob-keyfile")
+	clientFlags.StringVar(&blobKeyFile, "blob-keyfile", "", "A key `file` to derive the blob encryption key from")
+	clientFlags.StringVar(&blobPass, "blob-pass", "", "A `passphrase` to derive the blob encryption key from")
 	clientFlags.StringVar(&cipherSuite, "cipher", "A128GCM", "Name of cipher `suite` to use for encryption (see usage)")
+	clientFlags.BoolVar(&createDirs, "create-working-dir", false, "Create the -download and -wget-dir dirs and the dir of -blob if missing")
+	clientFlags.StringVar(&createDirMode, "create-working-dir-mode", "0700", "Octal permission `mode` of dirs created by -create-working-dir")
 	clientFlags.BoolVar(&debug, "debug", debug, "Print HTTP contents")
+	clientFlags.DurationVar(&deadline, "deadline", 0, "Maximum `duration` of the whole onboarding run (0 for no limit, exit code 3 when exceeded)")
+	clientFlags.StringVar(&dumpVoucher, "dump-voucher", "", "Write the voucher received in TO2 to `file` as CBOR, before it is verified")
+	clientFlags.BoolVar(&dumpTo1d, "dump-to1d", false, "Print the signed TO1 blob in CBOR diagnostic notation after TO1")
+	clientFlags.StringVar(&dnsServer, "dns-server", "", "DNS server `address` to resolve Owner hostnames with instead of the system resolver")
+	clientFlags.DurationVar(&dnsTimeout, "dns-timeout", 5*time.Second, "Maximum time to resolve an Owner hostname (0 for no limit)")
+	clientFlags.BoolVar(&failOnFSIMErr, "fail-on-fsim-error", false, "Fail onboarding, after saving the new credential without marking the device onboarded, if a service info module reported an error the owner did not treat as fatal")
 	clientFlags.StringVar(&dlDir, "download", "", "A `dir` to download files into (FSIM disabled if empty)")
+	clientFlags.StringVar(&dlMode, "download-mode", "0600", "Octal permission `mode` of downloaded files")
+	clientFlags.StringVar(&dlOwner, "download-owner", "", "Owner (\"user:group\", either may be omitted) of downloaded files, on Unix only")
 	clientFlags.StringVar(&diURL, "di", "http://127.0.0.1:8080", "HTTP base `URL` for DI server")
+	clientFlags.BoolVar(&diAttest, "di-attest", false, "Send the TPM EK certificate to the DI server (requires -tpm)")
+	clientFlags.StringVar(&diDeviceInfo, "di-device-info", "gotest", "The DeviceInfo `string` to send in DI as is, instead of -di-model and -di-firmware")
+	clientFlags.StringVar(&diFirmware, "di-firmware", "", "Firmware `version` to send in the DeviceInfo of DI")
+	clientFlags.StringVar(&diManifestPath, "di-manifest", "", "A JSON `file` of DI device info, serial number, key type, key encoding and RV info, overridden by their flags (YAML is not supported)")
+	clientFlags.StringVar(&diRvInfo, "di-rvinfo", "", "A `file` of RV info (CBOR or one directive per line) to store in the credential instead of the RV info from DI")
+	clientFlags.StringVar(&diModel, "di-model", "", "Device `model` to send in the DeviceInfo of DI")
+	clientFlags.StringVar(&diSerial, "di-serial-number", "", "Serial `number` to send in DI (randomly generated if empty)")
+	clientFlags.IntVar(&diRetries, "di-retries", 0, "Number of times to retry DI on transient network or server errors")
+	clientFlags.DurationVar(&diRetryDelay, "di-retry-delay", 5*time.Second, "Time to wait between DI retries")
 	clientFlags.StringVar(&diKey, "di-key", "ec384", "Key for device credential [options: ec256, ec384, rsa2048, rsa3072]")
+	clientFlags.StringVar(&diKeyType, "di-key-type", "", "Type of the device credential key instead of -di-key [options: ec, rsa]")
+	clientFlags.StringVar(&diKeyCurve, "di-key-curve", "", "Curve of an ec -di-key-type [options: P-256, P-384] (default P-384)")
+	clientFlags.IntVar(&diKeySize, "di-key-size", 0, "Size in `bits` of an rsa -di-key-type [options: 2048, 3072] (default 2048)")
 	clientFlags.StringVar(&diKeyEnc, "di-key-enc", "x509", "Public key encoding to use for manufacturer key [x509,x5chain,cose]")
 	clientFlags.BoolVar(&echoCmds, "echo-commands", false, "Echo all commands received to stdout (FSIM disabled if false)")
+	clientFlags.StringVar(&echoCmdsFile, "echo-commands-file", "", "Append each command received to `file` with a timestamp (implies -echo-commands)")
+	clientFlags.StringVar(&expectGUID, "expect-guid", "", "Refuse to onboard unless the device credential has this `guid` (hex, dashes allowed)")
+	clientFlags.StringVar(&expectReuse, "expect-reuse", "any", "Whether TO2 must use the Credential Reuse Protocol [any,yes,no]")
 	clientFlags.StringVar(&kexSuite, "kex", "ECDH384", "Name of cipher `suite` to use for key exchange (see usage)")
+	clientFlags.StringVar(&isolateDir, "isolate-fsims", "", "Confine each file system FSIM to its own subdir of `dir` (enables fdo.download, fdo.wget and fdo.upload)")
+	clientFlags.StringVar(&hmacHash, "hmac-hash", "auto", "HMAC of the device secret to provision and use [options: auto, sha256, sha384], auto allows either as selected by the key sizes")
+	clientFlags.StringVar(&hmacFile, "hmac-file", "", "Keep the HMAC secret of the blob credential in `file` instead of the blob")
 	clientFlags.BoolVar(&insecureTLS, "insecure-tls", false, "Skip TLS certificate verification")
+	clientFlags.BoolVar(&skipCertTime, "insecure-skip-cert-time", false, "Verify TLS certificates of DI, TO1 and TO2 servers without checking their validity period, for devices without a reliable clock")
+	clientFlags.StringVar(&keyFile, "key-file", "", "Keep the private key of the blob credential in PEM `file` instead of the blob")
+	clientFlags.StringVar(&livenessFile, "liveness-file", "", "A `file` to touch on each protocol message and every -liveness-interval while waiting")
+	clientFlags.StringVar(&statusAddr, "status-addr", "", "Serve /healthz and /status (JSON) over HTTP on `addr`, such as :9099, while the client runs")
+	clientFlags.DurationVar(&livenessInterval, "liveness-interval", 10*time.Second, "Time between updates of -liveness-file while waiting")
+	clientFlags.StringVar(&logFormat, "log-format", "text", "Log output `format` [text,json]")
+	clientFlags.StringVar(&logLevel, "log-level", "info", "Minimum `level` of messages to log [debug,info,warn,error] (-debug implies debug)")
+	clientFlags.IntVar(&maxOVEntries, "max-voucher-entries", 255, "Fail TO2 before fetching the voucher entries if the owner reports more than `n`")
+	clientFlags.StringVar(&metricsFile, "metrics-file", "", "Write Prometheus text format onboarding metrics to `path`")
+	clientFlags.StringVar(&outputDir, "output-dir", "", "A `dir` whose download and wget subdirs are used when -download or -wget-dir is not given")
+	clientFlags.BoolVar(&onboardAfterDI, "onboard-after-di", false, "After DI saves the device credential, run TO1 and TO2 in the same invocation")
+	clientFlags.Var(&ownerHeaders, "owner-header", "An HTTP `header` (\"Name: Value\") to add to TO1 and TO2 requests; "+
+		"a value of $NAME is read from the environment, flag may be provided multiple times")
+	clientFlags.StringVar(&ownerSNI, "owner-sni", "", "TLS server `name` to request and verify the Owner certificate against in TO2, instead of the host of the Owner URL")
+	clientFlags.BoolVar(&pinOwnerIP, "pin-owner-ip", false, "Connect to the same resolved IP of an Owner host for all messages of a TO1 or TO2 session, resolved with -dns-server and -dns-timeout")
+	clientFlags.StringVar(&postDlExec, "post-download-exec", "", "A `command` to run after TO2 with the paths of downloaded files as arguments")
+	clientFlags.StringVar(&pkcs11Module, "pkcs11-module", "", "Use the PKCS#11 module `library` for device credential secrets")
+	clientFlags.StringVar(&pkcs11Pin, "pkcs11-pin", "", "User `PIN` of the PKCS#11 token (visible to other users, prefer -pkcs11-pin-file or $FDO_PKCS11_PIN)")
+	clientFlags.StringVar(&pkcs11PinFile, "pkcs11-pin-file", "", "Read the user PIN of the PKCS#11 token from the first line of `file`")
+	clientFlags.IntVar(&pkcs11Slot, "pkcs11-slot", 0, "Slot `number` of the PKCS#11 token")
 	clientFlags.BoolVar(&printDevice, "print", false, "Print device credential blob and stop")
+	clientFlags.StringVar(&devmodArch, "devmod-arch", "", "Devmod arch and bin `name` to send instead of the client's GOARCH, when provisioning on behalf of another device")
+	clientFlags.StringVar(&devmodOS, "devmod-os", "", "Devmod os `name` to send instead of the client's GOOS, when provisioning on behalf of another device")
+	clientFlags.BoolVar(&printDevmodOnly, "print-devmod", false, "Print the devmod service info and modules which would be sent in TO2 and stop")
+	clientFlags.DurationVar(&progressInterval, "progress-interval", 5*time.Second, "Time between progress logs of fdo.download and fdo.upload transfers (0 disables)")
+	clientFlags.BoolVar(&probeOwners, "probe-owner", false, "Skip Owner URLs which do not respond like an FDO server before attempting TO2")
 	clientFlags.BoolVar(&rvOnly, "rv-only", false, "Perform TO1 then stop")
+	clientFlags.StringVar(&reportFile, "report", "", "Write a JSON timeline of the onboarding run to `file`")
+	clientFlags.BoolVar(&requireOnboard, "require-onboard", false, "Fail with exit code 4 if the device has already been onboarded")
+	clientFlags.Int64Var(&rateLimit, "rate-limit", 0, "Limit the file data of fdo.download, fdo.upload and fdo.wget together to `bytes` per second (0 is unlimited)")
 	clientFlags.BoolVar(&resale, "resale", false, "Perform resale")
+	clientFlags.StringVar(&saveVoucher, "save-voucher", "", "Write the device credential resulting from -resale to `file` as CBOR, without secrets")
+	clientFlags.BoolVar(&to1Only, "to1-only", false, "Perform TO1, save the TO1 blob to -to1-blob, then stop")
+	clientFlags.BoolVar(&to2Only, "to2-only", false, "Skip TO1 and perform TO2 using the TO1 blob saved at -to1-blob")
+	clientFlags.IntVar(&to2Concurrency, "to2-concurrency", 1, "Number of Owner URLs to run TO2 with at the same time, continuing with the first to reach service info")
+	clientFlags.IntVar(&to1Retries, "to1-retries", 0, "Number of times to retry the URLs of an RV directive when TO1 fails on all of them")
+	clientFlags.StringVar(&retryOn, "retry-on", "all", "Failures of TO1 and TO2 to try the next URL or retry after [all,transient], transient stops on voucher verification and unsupported key or algorithm errors")
+	clientFlags.DurationVar(&to1RetryDelay, "to1-retry-delay", 5*time.Second, "Time to wait between TO1 retries of an RV directive")
+	clientFlags.StringVar(&to1BlobPath, "to1-blob", "to1d.bin", "File `path` of the TO1 blob used by -to1-only and -to2-only")
+	clientFlags.BoolVar(&showSecrets, "show-secrets", false, "Include the HMAC secret and private key in -print output")
+	clientFlags.BoolVar(&shuffleURLs, "shuffle-urls", false, "Try the RV and bypass URLs of each directive and the Owner URLs from TO1 in random order")
+	clientFlags.BoolVar(&skipNVVerify, "skip-nv-verify", false, "Do not read back and compare the credential after writing it to TPM NV memory")
+	clientFlags.StringVar(&socks5Proxy, "socks5", "", "Connect through the SOCKS5 proxy at `address` (host:port or socks5://[user:pass@]host:port)")
+	clientFlags.StringVar(&rvInfoPath, "rv-info", "", "A `file` of RV info (CBOR or one directive per line) to use for this run instead of the RV info in the credential, which is not modified")
+	clientFlags.Var(&skipFsims, "skip-fsim", "List of service info `modules` to disable, such as fdo.command, "+
+		"comma-separated and/or flag provided multiple times")
+	clientFlags.StringVar(&sourceAddr, "source-addr", "", "Local IP `address` to make outbound connections from")
+	clientFlags.BoolVar(&tlsSessionCache, "tls-session-cache", true, "Resume TLS sessions to a server in later connections of the run, such as TO2 after TO1 and retries")
 	clientFlags.StringVar(&tpmPath, "tpm", "", "Use a TPM at `path` for device credential secrets")
 	clientFlags.Var(&uploads, "upload", "List of dirs and `files` to upload files from, "+
 		"comma-separated and/or flag provided multiple times (FSIM disabled if empty)")
+	clientFlags.BoolVar(&uploadCompress, "upload-compress", false, "Send a gzip compressed copy of a file when fdo.upload requests its name with .gz appended")
+	clientFlags.Var(&wgetAllowHosts, "wget-allow-host", "List of `hosts` fdo.wget may download from, "+
+		"comma-separated and/or flag provided multiple times (any host if empty)")
+	clientFlags.BoolVar(&watch, "watch", false, "After onboarding, run again each time a -blob file is replaced or modified, until interrupted")
+	clientFlags.StringVar(&wgetCA, "wget-ca", "", "A PEM `file` of CA certificates to verify fdo.wget HTTPS servers with instead of the system roots")
+	clientFlags.BoolVar(&wgetChecksumReq, "wget-checksum-required", false, "Fail fdo.wget downloads for which the owner sends no SHA-384 checksum")
 	clientFlags.StringVar(&wgetDir, "wget-dir", "", "A `dir` to wget files into (FSIM disabled if empty)")
+	clientFlags.BoolVar(&wgetInsecureTLS, "wget-insecure-tls", false, "Skip TLS certificate verification for fdo.wget downloads")
+}
+
+// resetRun clears the state collected by a previous run of client, so that
+// every device of multiple -blob values and every run of -watch starts anew.
+// The Owner URL failures of ownerCircuit are kept.
+func resetRun() {
+	blobEncrypted, blobCompressed = false, false
+	downloads, wgetFiles, uploadedFiles = nil, nil, nil
+	onboardReport.mu.Lock()
+	onboardReport.start, onboardReport.events = time.Time{}, nil
+	onboardReport.mu.Unlock()
+	onboardMetrics.To1Duration, onboardMetrics.To2Duration = 0, 0
+	onboardMetrics.To1Attempts, onboardMetrics.To2Attempts = 0, 0
+	onboardMetrics.Uploaded.Store(0)
+	fsimError.mu.Lock()
+	fsimError.module = ""
+	fsimError.mu.Unlock()
+	to2HmacSecret = nil
 }
 
 func client() error {
-	if debug {
-		level.Set(slog.LevelDebug)
+	resetRun()
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if insecureTLS {
+		slog.Warn("TLS certificate verification disabled for DI, TO1 and TO2 by -insecure-tls, do not use in production")
+	}
+	if skipCertTime && !insecureTLS {
+		slog.Warn("TLS certificate validity periods are not checked for DI, TO1 and TO2 by -insecure-skip-cert-time")
+	}
+	if wgetInsecureTLS {
+		slog.Warn("TLS certificate verification disabled for fdo.wget by -wget-insecure-tls, do not use in production")
 	}
 
 	// Catch interrupts
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	if deadline > 0 {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithTimeoutCause(ctx, deadline, errDeadline)
+		defer cancelDeadline()
+	}
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
 	go func() {
@@ -181,6 +390,32 @@ func client() error {
 		}
 	}()
 
+	if sourceAddr != "" {
+		tls.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceAddr)}
+	}
+	tls.PinIP = pinOwnerIP
+	tls.LookupHost = lookupHost
+	tls.SkipCertTime = skipCertTime
+	if tlsSessionCache && tls.SessionCache == nil {
+		tls.SessionCache = cryptotls.NewLRUClientSessionCache(0)
+	}
+	if socks5Proxy != "" {
+		// Already validated
+		tls.Socks5Addr, tls.Socks5Auth, _ = parseSocks5(socks5Proxy)
+	}
+
+	fsimRate = newRateLimiter(rateLimit)
+	if wgetDir != "" {
+		var err error
+		if wgetClient, err = newWgetClient(); err != nil {
+			return err
+		}
+	}
+
+	if printDevmodOnly {
+		return printDevmod()
+	}
+
 	if tpmPath != "" {
 		var err error
 		tpmc, err = tpm_utils.TpmOpen(tpmPath)
@@ -189,6 +424,12 @@ func client() error {
 		}
 		defer tpmc.Close()
 	}
+	if pkcs11Module != "" {
+		if err := pkcs11Open(); err != nil {
+			return err
+		}
+		defer func() { _ = pkcs11Close() }()
+	}
 
 	deviceStatus = FDO_STATE_PC
 
@@ -203,6 +444,12 @@ func client() error {
 				return err
 			}
 			deviceStatus = dc.State
+		} else if pkcs11Module != "" {
+			var dc fdoPkcs11DeviceCredential
+			if err := readCredFile(&dc); err != nil {
+				return err
+			}
+			deviceStatus = dc.State
 		} else {
 			var dc fdoDeviceCredential
 			if err := readCredFile(&dc); err != nil {
@@ -220,10 +467,44 @@ func client() error {
 
 	if deviceStatus == FDO_STATE_IDLE {
 		slog.Debug("FDO in Idle State. Device Onboarding already complete\n")
+		sdStatus("Onboarding already complete")
+		sdNotify("READY=1")
+		if requireOnboard {
+			return errAlreadyOnboarded
+		}
 		return nil
 	} else if deviceStatus == FDO_STATE_PRE_DI {
-		return di()
-	} else if deviceStatus == FDO_STATE_PRE_TO1 || deviceStatus == FDO_STATE_RESALE {
+		sdStatus("Running DI")
+		err := di(ctx)
+		switch {
+		case err != nil && onboardAfterDI:
+			return fmt.Errorf("DI failed, device not provisioned: %w", err)
+		case err != nil || !onboardAfterDI:
+			return err
+		}
+		// The credential has been synced to storage, so TO1 and TO2 can be
+		// run again if the client stops before completing them
+		fmt.Println("DI complete, device credential saved, starting onboarding")
+		deviceStatus = FDO_STATE_PRE_TO1
+	}
+	if deviceStatus == FDO_STATE_PRE_TO1 || deviceStatus == FDO_STATE_RESALE {
+		var onboarded bool
+		if metricsFile != "" {
+			defer func() {
+				if err := writeMetrics(metricsFile, onboarded, deviceStatus); err != nil {
+					slog.Error("Writing metrics failed", "path", metricsFile, "error", err)
+				}
+			}()
+		}
+		if reportFile != "" {
+			defer func() {
+				if err := writeReport(reportFile, onboarded, deviceStatus); err != nil {
+					slog.Error("Writing report failed", "path", reportFile, "error", err)
+				}
+			}()
+		}
+		defer printTransferSummary()
+		recordEvent(reportEvent{Event: "onboarding started"}, nil)
 
 		// Read device credential blob to configure client for TO1/TO2
 		dc, hmacSha256, hmacSha384, privateKey, cleanup, err := readCred()
@@ -233,47 +514,113 @@ func client() error {
 		if err != nil || printDevice {
 			return err
 		}
+		if hmacSha256, hmacSha384, err = restrictHmac(privateKey, hmacSha256, hmacSha384); err != nil {
+			return err
+		}
+		if err := checkHmacHash(dc.PublicKeyHash.Algorithm); err != nil {
+			return err
+		}
+		if expectGUID != "" {
+			// Already validated
+			if guid, _ := parseGUID(expectGUID); dc.GUID != guid {
+				return fmt.Errorf("device credential GUID %x does not match -expect-guid %x", dc.GUID, guid)
+			}
+		}
 
 		// Try TO1+TO2
 		kexCipherSuiteID, ok := kex.CipherSuiteByName(cipherSuite)
 		if !ok {
 			return fmt.Errorf("invalid key exchange cipher suite: %s", cipherSuite)
 		}
-		newDC := transferOwnership(ctx, dc.RvInfo, fdo.TO2Config{
-			Cred:       *dc,
-			HmacSha256: hmacSha256,
-			HmacSha384: hmacSha384,
-			Key:        privateKey,
-			Devmod: serviceinfo.Devmod{
-				Os:      runtime.GOOS,
-				Arch:    runtime.GOARCH,
-				Version: "Debian Bookworm",
-				Device:  "go-validation",
-				FileSep: ";",
-				Bin:     runtime.GOARCH,
-			},
+		if !kex.Available(kex.Suite(kexSuite), kexCipherSuiteID) {
+			return fmt.Errorf("key exchange suite %s with cipher suite %s is not supported by this client", kexSuite, cipherSuite)
+		}
+		rvInfo := dc.RvInfo
+		if rvInfoOverride != nil {
+			slog.Info("Using RV info override instead of the credential's", "path", rvInfoPath)
+			rvInfo = rvInfoOverride
+		}
+		newDC, err := transferOwnership(ctx, rvInfo, fdo.TO2Config{
+			Cred:                 *dc,
+			HmacSha256:           hmacSha256,
+			HmacSha384:           hmacSha384,
+			Key:                  privateKey,
+			Devmod:               deviceDevmod(),
 			KeyExchange:          kex.Suite(kexSuite),
 			CipherSuite:          kexCipherSuiteID,
 			AllowCredentialReuse: true,
 		})
-		if rvOnly {
+		if ctx.Err() != nil {
+			return ctxError(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		if rvOnly || to1Only {
 			return nil
 		}
 		if newDC == nil {
-			fmt.Println("Credential not updated (either due to failure of TO2 or the Credential Reuse Protocol")
+			fmt.Println("Credential not updated (Credential Reuse Protocol)")
+			if saveVoucher != "" && deviceStatus == FDO_STATE_RESALE {
+				slog.Warn("Owner used the Credential Reuse Protocol, so no resale credential was written", "path", saveVoucher)
+			}
+			if expectReuse == "no" {
+				return fmt.Errorf("owner used the Credential Reuse Protocol but -expect-reuse is no")
+			}
 			return nil
 		}
 
-		// Store new credential
+		// Store new credential. The owner has completed TO2, so the new
+		// credential is kept even when a service info module failed, but the
+		// device is not marked onboarded so that the next run onboards it
+		// again
+		state, failedFSIM := FDO_STATE_IDLE, ""
+		if failOnFSIMErr {
+			if failedFSIM = fsimErrorModule(); failedFSIM != "" {
+				state = FDO_STATE_PRE_TO1
+			}
+		}
+		// The post-download command runs before the device is marked
+		// onboarded, so that a failed command is run again by the next run
+		var hookErr error
+		if failedFSIM == "" && expectReuse != "yes" {
+			if hookErr = runPostDownloadExec(ctx); hookErr != nil {
+				state = FDO_STATE_PRE_TO1
+			}
+		}
+		if err := updateCred(*newDC, state); err != nil {
+			return fmt.Errorf("%w: %w", errCredSave, err)
+		}
+		// The resale credential is only an audit record, so failing to write
+		// it must not fail the run after the new credential is saved
+		if saveVoucher != "" && deviceStatus == FDO_STATE_RESALE {
+			if err := saveResaleCred(saveVoucher, *newDC); err != nil {
+				slog.Error("Writing the resale credential failed", "path", saveVoucher, "error", err)
+			}
+		}
+		deviceStatus = state
+		if expectReuse == "yes" {
+			// The owner has completed TO2, so the new credential is kept
+			return fmt.Errorf("owner replaced the credential but -expect-reuse is yes")
+		}
+		if failedFSIM != "" {
+			return fmt.Errorf("service info module %s reported an error during TO2 and -fail-on-fsim-error is set", failedFSIM)
+		}
+		if hookErr != nil {
+			return hookErr
+		}
+		onboarded = true
 		fmt.Println("FIDO Device Onboard Complete")
-		return updateCred(*newDC, FDO_STATE_IDLE)
+		sdStatus("Onboarding complete")
+		sdNotify("READY=1")
+		return nil
 	}
 	return fmt.Errorf("invalid state")
 }
 
-func di() (err error) { //nolint:gocyclo
+func di(ctx context.Context) (err error) { //nolint:gocyclo
 	// Generate new key and secret
-	secret := make([]byte, 32)
+	secret := make([]byte, hmacSecretSize())
 	if _, err := rand.Read(secret); err != nil {
 		return fmt.Errorf("error generating device secret: %w", err)
 	}
@@ -313,6 +660,16 @@ func di() (err error) { //nolint:gocyclo
 		defer func() { _ = cleanup() }()
 	}
 
+	// If using a PKCS#11 token, replace its key/hmac with new ones
+	if pkcs11Module != "" {
+		if hmacSha256, hmacSha384, key, err = pkcs11Cred(true); err != nil {
+			return err
+		}
+	}
+	if hmacSha256, hmacSha384, err = restrictHmac(key, hmacSha256, hmacSha384); err != nil {
+		return err
+	}
+
 	// Generate Java implementation-compatible mfg string
 	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
 		Subject:            pkix.Name{CommonName: "device.go-fdo"},
@@ -326,10 +683,25 @@ func di() (err error) { //nolint:gocyclo
 		return fmt.Errorf("error parsing CSR for device certificate chain: %w", err)
 	}
 
-	// Call the DI server
-	sn, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	headers, err := diHeaders()
 	if err != nil {
-		return fmt.Errorf("error generating random serial number: %w", err)
+		return err
+	}
+	var rvInfo [][]protocol.RvInstruction
+	if diRvInfo != "" {
+		if rvInfo, err = readRvInfoFile(diRvInfo); err != nil {
+			return err
+		}
+	} else if manifestRvInfo != nil {
+		rvInfo = manifestRvInfo
+	}
+
+	// Call the DI server
+	serialNumber := diSerial
+	if serialNumber == "" {
+		if serialNumber, err = randomSerialNumber(); err != nil {
+			return err
+		}
 	}
 	var keyEncoding protocol.KeyEncoding
 	switch {
@@ -342,19 +714,46 @@ func di() (err error) { //nolint:gocyclo
 	default:
 		return fmt.Errorf("unsupported key encoding: %s", diKeyEnc)
 	}
-	cred, err := fdo.DI(context.TODO(), tls.TlsTransport(diURL, nil, insecureTLS), custom.DeviceMfgInfo{
-		KeyType:      keyType,
-		KeyEncoding:  keyEncoding,
-		SerialNumber: strconv.FormatInt(sn.Int64(), 10),
-		DeviceInfo:   "gotest",
-		CertInfo:     cbor.X509CertificateRequest(*csr),
-	}, fdo.DIConfig{
-		HmacSha256: hmacSha256,
-		HmacSha384: hmacSha384,
-		Key:        key,
-	})
-	if err != nil {
-		return err
+	slog.Debug("Requesting manufacturer key encoding", "encoding", keyEncoding)
+	var cred *fdo.DeviceCredential
+	for attempt := 1; ; attempt++ {
+		slog.Debug("Running DI", "attempt", attempt, "serial number", serialNumber)
+		cred, err = fdo.DI(ctx, livenessTransport{tls.HeaderTransport(diURL, nil, insecureTLS, headers)}, custom.DeviceMfgInfo{
+			KeyType:      keyType,
+			KeyEncoding:  keyEncoding,
+			SerialNumber: serialNumber,
+			DeviceInfo:   diDeviceInfo,
+			CertInfo:     cbor.X509CertificateRequest(*csr),
+		}, fdo.DIConfig{
+			HmacSha256: hmacSha256,
+			HmacSha384: hmacSha384,
+			Key:        key,
+		})
+		if err == nil {
+			break
+		}
+		err = libError(err)
+		if ctx.Err() != nil {
+			return ctxError(ctx)
+		}
+		if attempt > diRetries || !isTransient(err) {
+			return clockSkewError(err)
+		}
+		slog.Warn("DI failed, retrying", "attempt", attempt, "delay", diRetryDelay, "error", err)
+
+		// Keep the serial number if supplied or the server may have
+		// recorded it
+		if diSerial == "" && !reachedServer(err) {
+			if serialNumber, err = randomSerialNumber(); err != nil {
+				return err
+			}
+		}
+		if err := waitAlive(ctx, diRetryDelay); err != nil {
+			return ctxError(ctx)
+		}
+	}
+	if rvInfo != nil {
+		cred.RvInfo = rvInfo
 	}
 
 	if tpmPath != "" {
@@ -366,6 +765,9 @@ func di() (err error) { //nolint:gocyclo
 			FDO_STATE_PRE_TO1,
 		})
 	}
+	if pkcs11Module != "" {
+		return saveCred(fdoPkcs11DeviceCredential{*cred, FDO_STATE_PRE_TO1})
+	}
 	err = saveCred(fdoDeviceCredential{
 		blob.DeviceCredential{
 			Active:           true,
@@ -386,77 +788,124 @@ func di() (err error) { //nolint:gocyclo
 	return err
 }
 
-func transferOwnership(ctx context.Context, rvInfo [][]protocol.RvInstruction, conf fdo.TO2Config) *fdo.DeviceCredential { //nolint:gocyclo
+func randomSerialNumber() (string, error) {
+	sn, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return "", fmt.Errorf("error generating random serial number: %w", err)
+	}
+	return strconv.FormatInt(sn.Int64(), 10), nil
+}
+
+func transferOwnership(ctx context.Context, rvInfo [][]protocol.RvInstruction, conf fdo.TO2Config) (*fdo.DeviceCredential, error) { //nolint:gocyclo
+	if ownerCircuit == nil {
+		ownerCircuit = newCircuitBreaker(circuitMax, circuitWait)
+	}
+
 	var to2URLs []string
-	directives := protocol.ParseDeviceRvInfo(rvInfo)
+	directives := rvDirectives(rvInfo)
 	for _, directive := range directives {
 		if !directive.Bypass {
 			continue
 		}
+		// Bypass URLs are tried in directive order, so that the RV info
+		// keeps its priorities, and in random order within a directive
+		shuffle(directive.URLs)
 		for _, url := range directive.URLs {
 			to2URLs = append(to2URLs, url.String())
 		}
 	}
 
-	// Try TO1 on each address only once
+	// Try TO1 on each address only once, unless a saved TO1 blob is used
 	var to1d *cose.Sign1[protocol.To1d, []byte]
+	to1Start := time.Now()
+	if to2Only {
+		var err error
+		to1d, err = readTo1Blob(to1BlobPath)
+		recordEvent(reportEvent{Event: "load TO1 blob", Detail: to1BlobPath}, err)
+		if err != nil {
+			return nil, err
+		}
+	}
 TO1:
 	for _, directive := range directives {
-		if directive.Bypass {
+		if directive.Bypass || to2Only {
 			continue
 		}
 
-		for _, url := range directive.URLs {
-			var err error
-			to1d, err = fdo.TO1(context.TODO(), tls.TlsTransport(url.String(), nil, insecureTLS), conf.Cred, conf.Key, nil)
-			if err != nil {
-				slog.Error("TO1 failed", "base URL", url.String(), "error", err)
-				continue
+		// A directive containing only RVDelaysec is used by some RV servers
+		// to throttle devices, so wait without attempting any connection
+		if len(directive.URLs) == 0 && directive.Delay != 0 {
+			slog.Debug("RV directive has no URLs, only applying delay", "delay", directive.Delay)
+		}
+		recordEvent(reportEvent{Event: "RV directive", Detail: fmt.Sprintf("%d URLs, delay %s", len(directive.URLs), directive.Delay)}, nil)
+
+		for attempt := 0; attempt <= to1Retries && len(directive.URLs) > 0; attempt++ {
+			if attempt > 0 {
+				slog.Warn("TO1 failed for all URLs of RV directive, retrying", "attempt", attempt, "delay", to1RetryDelay)
+				if err := waitAlive(ctx, to1RetryDelay); err != nil {
+					return nil, ctxError(ctx)
+				}
+			}
+			shuffle(directive.URLs)
+			for _, url := range directive.URLs {
+				if ctx.Err() != nil {
+					return nil, ctxError(ctx)
+				}
+				var err error
+				onboardMetrics.To1Attempts++
+				sdStatus("Running TO1 with " + url.String())
+				to1d, err = fdo.TO1(ctx, livenessTransport{tls.HeaderTransport(url.String(), nil, insecureTLS, http.Header(ownerHeaders))}, conf.Cred, conf.Key, nil)
+				err = clockSkewError(libError(err))
+				recordEvent(reportEvent{Event: "TO1", URL: url.String()}, err)
+				if err != nil {
+					slog.Error("TO1 failed", "base URL", url.String(), "error", err)
+					if retryOn == "transient" && isPermanent(err) {
+						return nil, fmt.Errorf("%w: %w", errTO1Failed, err)
+					}
+					continue
+				}
+				break TO1
 			}
-			break TO1
 		}
 
 		if directive.Delay != 0 {
-			// A 25% plus or minus jitter is allowed by spec
-			select {
-			case <-ctx.Done():
-				return nil
-			case <-time.After(directive.Delay):
+			if err := rvDelay(ctx, directive.Delay); err != nil {
+				return nil, ctxError(ctx)
 			}
 		}
 	}
-	if to1d != nil {
-		for _, to2Addr := range to1d.Payload.Val.RV {
-			if to2Addr.DNSAddress == nil && to2Addr.IPAddress == nil {
-				slog.Error("Error: Both IP and DNS can't be null")
-				continue
-			}
-
-			var scheme, port string
-			switch to2Addr.TransportProtocol {
-			case protocol.HTTPTransport:
-				scheme, port = "http://", "80"
-			case protocol.HTTPSTransport:
-				scheme, port = "https://", "443"
-			default:
-				continue
+	// The default delay after the last directive (120s with jitter) is not
+	// applied, as TO1 is not restarted once every directive has failed
+	onboardMetrics.To1Duration = time.Since(to1Start)
+	if to1d == nil && (len(to2URLs) == 0 || to1Only || rvOnly) {
+		for _, directive := range directives {
+			if !directive.Bypass && len(directive.URLs) > 0 {
+				return nil, errTO1Failed
 			}
-			if to2Addr.Port != 0 {
-				port = strconv.Itoa(int(to2Addr.Port))
-			}
-
-			// Check and add DNS address if valid and resolvable
-			if to2Addr.DNSAddress != nil && isResolvableDNS(*to2Addr.DNSAddress) {
-				host := *to2Addr.DNSAddress
-				to2URLs = append(to2URLs, scheme+net.JoinHostPort(host, port))
+		}
+		return nil, errNoRvInfo
+	}
+	if to1d != nil {
+		ownerURLs := ownerURLsFromTO1(ctx, to1d.Payload.Val)
+		shuffle(ownerURLs)
+		to2URLs = append(to2URLs, ownerURLs...)
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx)
+		}
+		if dumpTo1d {
+			if err := dumpTo1Blob(to1d); err != nil {
+				slog.Error("Dumping TO1 blob failed", "error", err)
 			}
+		}
+	}
 
-			// Check and add IP address if valid
-			if to2Addr.IPAddress != nil && isValidIP(to2Addr.IPAddress.String()) {
-				host := to2Addr.IPAddress.String()
-				to2URLs = append(to2URLs, scheme+net.JoinHostPort(host, port))
-			}
+	// Save the TO1 blob for a later -to2-only run
+	if to1Only {
+		if err := saveTo1Blob(to1BlobPath, to1d); err != nil {
+			return nil, err
 		}
+		fmt.Printf("TO1 Blob saved to %s\n", to1BlobPath)
+		return nil, nil
 	}
 
 	// Print TO2 addrs if RV-only
@@ -464,58 +913,215 @@ TO1:
 		if to1d != nil {
 			fmt.Printf("TO1 Blob: %+v\n", to1d.Payload.Val)
 		}
-		return nil
+		return nil, nil
 	}
 
-	// Try TO2 on each address only once
+	// Try TO2 on each address only once, moving on to the next after any
+	// failure
+	to2Start := time.Now()
+	defer func() { onboardMetrics.To2Duration = time.Since(to2Start) }()
+	to2URLs = dedupeURLs(ctx, to2URLs)
+	if probeOwners {
+		to2URLs = filterOwners(ctx, to2URLs)
+	}
+	if to2Concurrency > 1 {
+		return raceTransferOwnership(ctx, to2URLs, to1d, conf)
+	}
+	lastErr := errors.New("no owner URL to try")
 	for _, baseURL := range to2URLs {
-		newDC := transferOwnership2(tls.TlsTransport(baseURL, nil, insecureTLS), to1d, conf)
-		if newDC != nil {
-			return newDC
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx)
+		}
+		if !ownerCircuit.Allow(baseURL) {
+			continue
 		}
+		onboardMetrics.To2Attempts++
+		sdStatus("Running TO2 with " + baseURL)
+		newDC, err := transferOwnership2(ctx, ownerTransport(baseURL), to1d, conf)
+		recordEvent(reportEvent{Event: "TO2", URL: baseURL}, err)
+		if err != nil {
+			slog.Error("TO2 failed", "base URL", baseURL, "error", err)
+			ownerCircuit.Failure(baseURL)
+			lastErr = err
+			if retryOn == "transient" && isPermanent(err) {
+				slog.Error("TO2 failed with a permanent error, not trying other owner URLs")
+				break
+			}
+			continue
+		}
+		// A nil credential without error means the Credential Reuse
+		// Protocol was used
+		ownerCircuit.Success(baseURL)
+		return newDC, nil
 	}
 
-	return nil
+	return nil, fmt.Errorf("%w: %w", errTO2Failed, lastErr)
+}
+
+// rvDirectives parses the RV info of the device credential. A port of 0 means
+// the default port of the URL's scheme, see defaultPort.
+func rvDirectives(rvInfo [][]protocol.RvInstruction) []protocol.RvDirective {
+	directives := protocol.ParseDeviceRvInfo(rvInfo)
+	for _, directive := range directives {
+		for _, u := range directive.URLs {
+			if u.Port() == "0" {
+				u.Host = net.JoinHostPort(u.Hostname(), defaultPort(u.Scheme))
+			}
+		}
+	}
+	return directives
+}
+
+// ownerTLSConfig returns the TLS settings of TO2 connections, which use the
+// -owner-sni server name if set, so that an Owner reached by IP can present a
+// certificate for its host name.
+func ownerTLSConfig() *cryptotls.Config {
+	if ownerSNI == "" {
+		return nil
+	}
+	conf := tls.DefaultConfig(insecureTLS)
+	conf.ServerName = ownerSNI
+	return conf
+}
+
+// ownerURLsFromTO1 returns the base URLs of the TO2 addresses in a TO1 blob.
+// HTTP and HTTPS addresses use the scheme's default port unless a port is
+// given. An address with both a DNS name and an IP yields a URL for each, DNS
+// names which do not resolve and invalid IPs are skipped, as are addresses of
+// other transport protocols. It stops early when the context is canceled.
+func ownerURLsFromTO1(ctx context.Context, to1d protocol.To1d) []string {
+	var urls []string
+	for _, to2Addr := range to1d.RV {
+		if ctx.Err() != nil {
+			return urls
+		}
+		if to2Addr.DNSAddress == nil && to2Addr.IPAddress == nil {
+			slog.Error("Error: Both IP and DNS can't be null")
+			continue
+		}
+
+		var scheme string
+		switch to2Addr.TransportProtocol {
+		case protocol.HTTPTransport:
+			scheme = "http"
+		case protocol.HTTPSTransport:
+			scheme = "https"
+		default:
+			continue
+		}
+		port := defaultPort(scheme)
+		if to2Addr.Port != 0 {
+			port = strconv.Itoa(int(to2Addr.Port))
+		}
+		scheme += "://"
+
+		// Check and add DNS address if valid and resolvable
+		if to2Addr.DNSAddress != nil && isResolvableDNS(ctx, *to2Addr.DNSAddress) {
+			host := *to2Addr.DNSAddress
+			urls = append(urls, scheme+net.JoinHostPort(host, port))
+		}
+
+		// Check and add IP address if valid
+		if to2Addr.IPAddress != nil && isValidIP(to2Addr.IPAddress.String()) {
+			host := to2Addr.IPAddress.String()
+			urls = append(urls, scheme+net.JoinHostPort(host, port))
+		}
+	}
+	return urls
+}
+
+// ownerTransport returns the transport of TO2 with the owner at baseURL.
+func ownerTransport(baseURL string) fdo.Transport {
+	return &voucherTransport{Transport: livenessTransport{tls.HeaderTransport(baseURL, ownerTLSConfig(), insecureTLS, http.Header(ownerHeaders))}}
 }
 
-func transferOwnership2(transport fdo.Transport, to1d *cose.Sign1[protocol.To1d, []byte], conf fdo.TO2Config) *fdo.DeviceCredential {
+// transferOwnership2 runs TO2 against a single owner. Failures during the
+// service info exchange are returned as a *ServiceInfoError.
+func transferOwnership2(ctx context.Context, transport fdo.Transport, to1d *cose.Sign1[protocol.To1d, []byte], conf fdo.TO2Config) (*fdo.DeviceCredential, error) {
+	// Devmod advertises exactly the modules in this map via its nummodules
+	// and modules messages, so only enabled FSIMs may be included
+	var failedModule string
+	fsims := initializeFSIMs()
+	slog.Debug("Advertising service info modules", "modules", moduleNames(fsims))
+	conf.DeviceModules = trackModules(fsims, &failedModule)
+
+	cred, err := fdo.TO2(ctx, transport, to1d, conf)
+	if err != nil {
+		return nil, serviceInfoError(suiteError(clockSkewError(libError(err)), conf), failedModule)
+	}
+	return cred, nil
+}
+
+// initializeFSIMs creates the device service info modules enabled by flags and
+// those added with RegisterDeviceModule.
+func initializeFSIMs() map[string]serviceinfo.DeviceModule {
 	fsims := map[string]serviceinfo.DeviceModule{
 		"fido_alliance": &fsim.Interop{},
 	}
 	if dlDir != "" {
-		fsims["fdo.download"] = &fsim.Download{
+		recorder := new(downloadRecorder)
+		recorder.DeviceModule = &fsim.Download{
 			CreateTemp: func() (*os.File, error) {
-				tmpFile, err := os.CreateTemp(dlDir, ".fdo.download_*")
-				if err != nil {
-					return nil, err
+				tmpFile, err := createDownloadTemp(dlDir)
+				if err == nil {
+					recorder.created(tmpFile)
 				}
-				return tmpFile, nil
+				return tmpFile, err
 			},
 			NameToPath: func(name string) string {
-				cleanName := filepath.Clean(name)
-				if !filepath.IsAbs(cleanName) {
-					return filepath.Join(dlDir, cleanName)
+				path, err := downloadPath(dlDir, name)
+				if err != nil {
+					// The empty path fails the rename, so the owner is sent a
+					// failed download
+					_, _ = fmt.Fprintln(slogErrorWriter{module: "fdo.download"}, err)
+					return ""
 				}
-				return filepath.Join(dlDir, filepath.Base(cleanName))
+				recorder.resolved(path)
+				return path
 			},
+			ErrorLog: slogErrorWriter{module: "fdo.download"},
+		}
+		fsims["fdo.download"] = recorder
+		if p := newProgress("fdo.download", progressInterval); p != nil {
+			fsims["fdo.download"] = progressModule{DeviceModule: fsims["fdo.download"], p: p}
+		}
+		if fsimRate != nil {
+			fsims["fdo.download"] = rateModule{DeviceModule: fsims["fdo.download"], l: fsimRate}
 		}
 	}
-	if echoCmds {
+	if echoCmds || echoCmdsFile != "" {
 		fsims["fdo.command"] = &fsim.Command{
 			Timeout: time.Second,
 			Transform: func(cmd string, args []string) (string, []string) {
+				if echoCmdsFile != "" {
+					recordCommand(cmd, args)
+				}
 				sanitizedArgs := make([]string, len(args))
 				for i, arg := range args {
 					sanitizedArgs[i] = fmt.Sprintf("%q", arg)
 				}
-				return "sh", []string{"-c", fmt.Sprintf("echo %s", strings.Join(sanitizedArgs, " "))}
+				script := fmt.Sprintf("echo %s", strings.Join(sanitizedArgs, " "))
+				if commandDir != "" {
+					script = "cd " + shellQuote(commandDir) + " && " + script
+				}
+				return "sh", []string{"-c", script}
 			},
 		}
 	}
 	if len(uploads) > 0 {
-		fsims["fdo.upload"] = &fsim.Upload{
-			FS: uploads,
+		var uploadFS fs.FS = uploads
+		if uploadCompress {
+			uploadFS = gzipFS{FS: uploadFS}
+		}
+		uploadFS = countingFS{FS: uploadFS, n: &onboardMetrics.Uploaded}
+		ctx := new(receiveCtx)
+		if fsimRate != nil {
+			uploadFS = rateFS{FS: uploadFS, l: fsimRate, ctx: ctx}
 		}
+		if p := newProgress("fdo.upload", progressInterval); p != nil {
+			uploadFS = progressFS{FS: uploadFS, p: p}
+		}
+		fsims["fdo.upload"] = receiveCtxModule{DeviceModule: &fsim.Upload{FS: uploadFS}, ctx: ctx}
 	}
 	if wgetDir != "" {
 		fsims["fdo.wget"] = &fsim.Wget{
@@ -527,23 +1133,132 @@ func transferOwnership2(transport fdo.Transport, to1d *cose.Sign1[protocol.To1d,
 				return tmpFile, nil
 			},
 			NameToPath: func(name string) string {
-				cleanName := filepath.Clean(name)
-				if !filepath.IsAbs(cleanName) {
-					return filepath.Join(wgetDir, cleanName)
+				path, err := downloadPath(wgetDir, name)
+				if err != nil {
+					_, _ = fmt.Fprintln(slogErrorWriter{module: "fdo.wget"}, err)
+					return ""
+				}
+				if !slices.Contains(wgetFiles, path) {
+					wgetFiles = append(wgetFiles, path)
 				}
-				return filepath.Join(wgetDir, filepath.Base(cleanName))
+				return path
 			},
 			Timeout: 10 * time.Second,
+			Client:  wgetClient,
 		}
+		if wgetChecksumReq {
+			fsims["fdo.wget"] = &wgetChecksumModule{DeviceModule: fsims["fdo.wget"]}
+		}
+	}
+	for name, factory := range customModules {
+		fsims[name] = factory()
 	}
-	conf.DeviceModules = fsims
+	for _, name := range skipFsims {
+		delete(fsims, name)
+	}
+	return fsims
+}
+
+// moduleNames returns the sorted names of the given service info modules.
+func moduleNames(fsims map[string]serviceinfo.DeviceModule) []string {
+	names := make([]string, 0, len(fsims))
+	for name := range fsims {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
 
-	cred, err := fdo.TO2(context.TODO(), transport, to1d, conf)
+// rvDelay waits for an RV directive delay, returning early with an error if
+// the context is canceled.
+func rvDelay(ctx context.Context, delay time.Duration) error {
+	delay = jitter(delay)
+	slog.Debug("Applying RV directive delay", "delay", delay)
+	sdStatus("Waiting " + delay.Round(time.Second).String() + " for RV directive delay")
+	return waitAlive(ctx, delay)
+}
+
+// jitter randomly adjusts a delay by up to 25% in either direction, as allowed
+// by spec.
+func jitter(delay time.Duration) time.Duration {
+	spread := int64(delay) / 2
+	if spread <= 0 {
+		return delay
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(spread+1))
 	if err != nil {
-		slog.Error("TO2 failed", "error", err)
-		return nil
+		return delay
+	}
+	return delay - delay/4 + time.Duration(n.Int64())
+}
+
+// shuffle randomizes the order of URLs if -shuffle-urls is set, so that
+// devices starting at the same time spread their load over equivalent
+// servers. Otherwise the order is unchanged.
+func shuffle[T any](urls []T) {
+	if !shuffleURLs {
+		return
 	}
-	return cred
+	mathrand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+}
+
+// dedupeURLs removes duplicate base URLs, preserving order. URLs are compared
+// after normalizing the scheme and host case and making the port explicit. A
+// URL whose host name resolves to the address of an earlier URL with the same
+// scheme and port, such as the DNS name and IP of one TO2 address, reaches the
+// same endpoint and is a duplicate too.
+func dedupeURLs(ctx context.Context, urls []string) []string {
+	seen := make(map[string]bool, len(urls))
+	unique := make([]string, 0, len(urls))
+	for _, rawURL := range urls {
+		keys := endpointKeys(ctx, rawURL)
+		if slices.ContainsFunc(keys, func(key string) bool { return seen[key] }) {
+			slog.Debug("Skipping duplicate URL", "url", rawURL)
+			continue
+		}
+		for _, key := range keys {
+			seen[key] = true
+		}
+		unique = append(unique, rawURL)
+	}
+	return unique
+}
+
+// endpointKeys returns the normalized URL and, if its host is a name, the URL
+// with each address the name resolves to. Names are not resolved through a
+// -socks5 proxy, which resolves them itself.
+func endpointKeys(ctx context.Context, rawURL string) []string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return []string{rawURL}
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" || port == "0" {
+		port = defaultPort(scheme)
+	}
+	hosts := []string{host}
+	if ip := net.ParseIP(host); ip != nil {
+		hosts[0] = ip.String()
+	} else if socks5Proxy == "" {
+		addrs, _ := lookupHost(ctx, host)
+		hosts = append(hosts, addrs...)
+	}
+	keys := make([]string, len(hosts))
+	for i, host := range hosts {
+		keys[i] = scheme + "://" + net.JoinHostPort(host, port) + strings.TrimSuffix(u.EscapedPath(), "/")
+	}
+	return keys
+}
+
+// defaultPort returns the port used for an HTTP or HTTPS URL without one. A
+// port of 0 in a TO2 address or RV directive also means the default, so that
+// URLs such as http://host:0 are never produced.
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
 }
 
 // Function to validate if a string is a valid IP address
@@ -552,9 +1267,44 @@ func isValidIP(ip string) bool {
 }
 
 // Function to check if a DNS address is resolvable
-func isResolvableDNS(dns string) bool {
-	_, err := net.LookupHost(dns)
-	return err == nil
+func isResolvableDNS(ctx context.Context, dns string) bool {
+	// The proxy resolves host names, which may not resolve locally
+	if socks5Proxy != "" {
+		return true
+	}
+	if _, err := lookupHost(ctx, dns); err != nil {
+		slog.Warn("DNS lookup failed, skipping address", "host", dns, "error", err)
+		return false
+	}
+	return true
+}
+
+// lookupHost resolves a host name with the -dns-server, within -dns-timeout.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if dnsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+	return dnsResolver().LookupHost(ctx, host)
+}
+
+// dnsResolver returns a resolver using the -dns-server, if set.
+func dnsResolver() *net.Resolver {
+	if dnsServer == "" {
+		return net.DefaultResolver
+	}
+	server := dnsServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
 }
 func printDeviceStatus(status FdoDeviceState) {
 	switch status {
@@ -0,0 +1,445 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/custom"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+func TestOwnerURLsFromTO1(t *testing.T) {
+	defer func(timeout time.Duration) { dnsTimeout = timeout }(dnsTimeout)
+	dnsTimeout = 2 * time.Second
+
+	dns := func(name string) *string { return &name }
+	ip := func(s string) *net.IP { addr := net.ParseIP(s); return &addr }
+	for _, test := range []struct {
+		name string
+		addr protocol.RvTO2Addr
+		want []string
+	}{
+		{
+			name: "http default port",
+			addr: protocol.RvTO2Addr{IPAddress: ip("192.0.2.1"), TransportProtocol: protocol.HTTPTransport},
+			want: []string{"http://192.0.2.1:80"},
+		},
+		{
+			name: "https default port",
+			addr: protocol.RvTO2Addr{IPAddress: ip("192.0.2.1"), TransportProtocol: protocol.HTTPSTransport},
+			want: []string{"https://192.0.2.1:443"},
+		},
+		{
+			name: "custom port",
+			addr: protocol.RvTO2Addr{IPAddress: ip("192.0.2.1"), Port: 8443, TransportProtocol: protocol.HTTPSTransport},
+			want: []string{"https://192.0.2.1:8443"},
+		},
+		{
+			name: "ipv6",
+			addr: protocol.RvTO2Addr{IPAddress: ip("2001:db8::1"), Port: 8080, TransportProtocol: protocol.HTTPTransport},
+			want: []string{"http://[2001:db8::1]:8080"},
+		},
+		{
+			name: "resolvable dns",
+			addr: protocol.RvTO2Addr{DNSAddress: dns("localhost"), Port: 8080, TransportProtocol: protocol.HTTPTransport},
+			want: []string{"http://localhost:8080"},
+		},
+		{
+			name: "dns and ip",
+			addr: protocol.RvTO2Addr{DNSAddress: dns("localhost"), IPAddress: ip("127.0.0.1"), Port: 8080, TransportProtocol: protocol.HTTPTransport},
+			want: []string{"http://localhost:8080", "http://127.0.0.1:8080"},
+		},
+		{
+			name: "unresolvable dns",
+			addr: protocol.RvTO2Addr{DNSAddress: dns("owner.invalid"), TransportProtocol: protocol.HTTPTransport},
+		},
+		{
+			name: "unresolvable dns with ip",
+			addr: protocol.RvTO2Addr{DNSAddress: dns("owner.invalid"), IPAddress: ip("192.0.2.1"), TransportProtocol: protocol.HTTPTransport},
+			want: []string{"http://192.0.2.1:80"},
+		},
+		{
+			name: "both nil",
+			addr: protocol.RvTO2Addr{Port: 8080, TransportProtocol: protocol.HTTPTransport},
+		},
+		{
+			name: "other transport",
+			addr: protocol.RvTO2Addr{IPAddress: ip("192.0.2.1"), Port: 8080, TransportProtocol: protocol.TCPTransport},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := ownerURLsFromTO1(context.Background(), protocol.To1d{RV: []protocol.RvTO2Addr{test.addr}})
+			if !slices.Equal(got, test.want) {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestDefaultPort(t *testing.T) {
+	for scheme, want := range map[string]string{"http": "80", "https": "443"} {
+		if got := defaultPort(scheme); got != want {
+			t.Errorf("%s: expected port %s, got %s", scheme, want, got)
+		}
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for _, test := range []struct {
+		name string
+		addr protocol.RvTO2Addr
+		want string
+	}{
+		{
+			name: "http port 0",
+			addr: protocol.RvTO2Addr{IPAddress: &ip, Port: 0, TransportProtocol: protocol.HTTPTransport},
+			want: "http://192.0.2.1:80",
+		},
+		{
+			name: "https port 0",
+			addr: protocol.RvTO2Addr{IPAddress: &ip, Port: 0, TransportProtocol: protocol.HTTPSTransport},
+			want: "https://192.0.2.1:443",
+		},
+		{
+			name: "non-standard port",
+			addr: protocol.RvTO2Addr{IPAddress: &ip, Port: 8043, TransportProtocol: protocol.HTTPSTransport},
+			want: "https://192.0.2.1:8043",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := ownerURLsFromTO1(context.Background(), protocol.To1d{RV: []protocol.RvTO2Addr{test.addr}})
+			if len(got) != 1 || got[0] != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRvDirectivesPort(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		proto uint8
+		port  *uint16
+		want  string
+	}{
+		{name: "http port 0", proto: protocol.RVProtHTTP, port: new(uint16), want: "http://192.0.2.1:80"},
+		{name: "https port 0", proto: protocol.RVProtHTTPS, port: new(uint16), want: "https://192.0.2.1:443"},
+		{name: "http missing port", proto: protocol.RVProtHTTP, want: "http://192.0.2.1:80"},
+		{name: "https missing port", proto: protocol.RVProtHTTPS, want: "https://192.0.2.1:443"},
+		{name: "non-standard port", proto: protocol.RVProtHTTP, port: func() *uint16 { p := uint16(8080); return &p }(), want: "http://192.0.2.1:8080"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			directive := []protocol.RvInstruction{
+				rvInstruction(t, protocol.RVIPAddress, net.ParseIP("192.0.2.1")),
+				rvInstruction(t, protocol.RVProtocol, test.proto),
+			}
+			if test.port != nil {
+				directive = append(directive, rvInstruction(t, protocol.RVDevPort, *test.port))
+			}
+			directives := rvDirectives([][]protocol.RvInstruction{directive})
+			if len(directives) != 1 || len(directives[0].URLs) != 1 {
+				t.Fatalf("expected one URL, got %+v", directives)
+			}
+			if got := directives[0].URLs[0].String(); got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+// rvInstruction returns an RV instruction with the CBOR encoded value.
+func rvInstruction(t *testing.T, v protocol.RvVar, value any) protocol.RvInstruction {
+	t.Helper()
+	data, err := cbor.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protocol.RvInstruction{Variable: v, Value: data}
+}
+
+func TestTransferOwnershipCanceled(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unexpected request", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range []struct {
+		name   string
+		rvInfo string
+	}{
+		{name: "to1", rvInfo: "protocol=http ip=127.0.0.1 port=" + testPort(t, srv.URL)},
+		{name: "bypass", rvInfo: "protocol=http ip=127.0.0.1 port=" + testPort(t, srv.URL) + " bypass"},
+		{name: "to1 then delay", rvInfo: "protocol=http dns=localhost port=" + testPort(t, srv.URL) + "\ndelay=1h"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resetRun()
+			rvInfo, err := parseRvInfo([]byte(test.rvInfo))
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			_, err = transferOwnership(ctx, rvInfo, testTO2Config(t))
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("expected an interrupted error, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("expected a prompt return, took %s", elapsed)
+			}
+		})
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("expected no requests, got %d", n)
+	}
+
+	if urls := ownerURLsFromTO1(ctx, protocol.To1d{RV: []protocol.RvTO2Addr{
+		{DNSAddress: func() *string { s := "localhost"; return &s }(), TransportProtocol: protocol.HTTPTransport},
+	}}); len(urls) != 0 {
+		t.Errorf("expected no owner URLs with a canceled context, got %q", urls)
+	}
+}
+
+// testPort returns the port of a test server URL.
+func testPort(t *testing.T, rawURL string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Port()
+}
+
+// testTO2Config returns a TO2 config with a new device key, which is enough
+// for TO1 and TO2 to send their first message.
+func testTO2Config(t *testing.T) fdo.TO2Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fdo.TO2Config{Cred: fdo.DeviceCredential{}, Key: key}
+}
+
+func TestTransferOwnershipBypassFailover(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadPort := testPort(t, dead.URL)
+	dead.Close()
+
+	var mu sync.Mutex
+	var hellos []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/msg/60") {
+			mu.Lock()
+			hellos = append(hellos, r.Host)
+			mu.Unlock()
+		}
+		http.Error(w, "owner unavailable", http.StatusServiceUnavailable)
+	})
+	srv1, srv2 := httptest.NewServer(handler), httptest.NewServer(handler)
+	defer srv1.Close()
+	defer srv2.Close()
+	port1, port2 := testPort(t, srv1.URL), testPort(t, srv2.URL)
+
+	// The DNS name and IP of the second directive are the same endpoint
+	resetRun()
+	rvInfo, err := parseRvInfo([]byte("protocol=http ip=127.0.0.1 port=" + deadPort + " bypass\n" +
+		"protocol=http dns=localhost ip=127.0.0.1 port=" + port1 + " bypass\n" +
+		"protocol=http ip=127.0.0.1 port=" + port2 + " bypass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transferOwnership(context.Background(), rvInfo, testTO2Config(t)); !errors.Is(err, errTO2Failed) {
+		t.Fatalf("expected TO2 to fail on all owner URLs, got %v", err)
+	}
+
+	// The dead URL of the first directive does not stop the others from
+	// being tried, in directive order
+	want := []string{"localhost:" + port1, "127.0.0.1:" + port2}
+	if !slices.Equal(hellos, want) {
+		t.Errorf("expected TO2 with %q, got %q", want, hellos)
+	}
+	if n := onboardMetrics.To2Attempts; n != 3 {
+		t.Errorf("expected 3 TO2 attempts, got %d", n)
+	}
+	if n := onboardMetrics.To1Attempts; n != 0 {
+		t.Errorf("expected bypass directives to skip TO1, got %d attempts", n)
+	}
+}
+
+func TestDedupeURLs(t *testing.T) {
+	defer func(timeout time.Duration) { dnsTimeout = timeout }(dnsTimeout)
+	dnsTimeout = 2 * time.Second
+
+	got := dedupeURLs(context.Background(), []string{
+		"http://localhost:8080",
+		"http://127.0.0.1:8080",
+		"http://LOCALHOST:8080/",
+		"https://localhost:8080",
+		"http://127.0.0.1:8081",
+		"http://192.0.2.1",
+		"http://192.0.2.1:80",
+		"http://192.0.2.1:0",
+		"https://192.0.2.1",
+		"http://[2001:db8:0::1]:80",
+		"http://[2001:db8::1]",
+	})
+	want := []string{
+		"http://localhost:8080",
+		"https://localhost:8080",
+		"http://127.0.0.1:8081",
+		"http://192.0.2.1",
+		"https://192.0.2.1",
+		"http://[2001:db8:0::1]:80",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestDIKeyEncoding(t *testing.T) {
+	defer func(url, key, enc, blob string) {
+		diURL, diKey, diKeyEnc, blobPath = url, key, enc, blob
+	}(diURL, diKey, diKeyEnc, blobPath)
+
+	var got []protocol.KeyEncoding
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/msg/10") {
+			var appStart struct {
+				DeviceMfgInfo cbor.Bstr[custom.DeviceMfgInfo]
+			}
+			if err := cbor.NewDecoder(r.Body).Decode(&appStart); err != nil {
+				t.Errorf("error decoding DI.AppStart: %v", err)
+			}
+			got = append(got, appStart.DeviceMfgInfo.Val.KeyEncoding)
+		}
+		http.Error(w, "not a manufacturer", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	diURL, diKey, blobPath = srv.URL, "ec256", filepath.Join(t.TempDir(), "cred.bin")
+	for enc, want := range map[string]protocol.KeyEncoding{
+		"x509":    protocol.X509KeyEnc,
+		"x5chain": protocol.X5ChainKeyEnc,
+		"cose":    protocol.CoseKeyEnc,
+	} {
+		got, diKeyEnc = nil, enc
+		if err := di(context.Background()); err == nil {
+			t.Fatalf("%s: expected DI to fail against the test server", enc)
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("%s: expected key encoding %v, got %v", enc, want, got)
+		}
+	}
+}
+
+func TestTransferOwnershipDelayOnlyDirective(t *testing.T) {
+	var to1At time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/msg/30") && to1At.IsZero() {
+			to1At = time.Now()
+		}
+		http.Error(w, "rendezvous unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	logs := &recordHandler{}
+	defer func(logger *slog.Logger) { slog.SetDefault(logger) }(slog.Default())
+	slog.SetDefault(slog.New(logs))
+
+	resetRun()
+	rvInfo, err := parseRvInfo([]byte("delay=1\nprotocol=http ip=127.0.0.1 port=" + testPort(t, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := transferOwnership(context.Background(), rvInfo, testTO2Config(t)); !errors.Is(err, errTO1Failed) {
+		t.Fatalf("expected TO1 to fail on the RV URL, got %v", err)
+	}
+
+	// The delay of 1s is jittered by up to 25% before the next directive,
+	// allowing 500ms for a slow test machine
+	if to1At.IsZero() {
+		t.Fatal("expected TO1 with the directive after the delay")
+	}
+	if waited := to1At.Sub(start); waited < 750*time.Millisecond || waited > 1750*time.Millisecond {
+		t.Errorf("expected TO1 after the jittered 1s delay, waited %s", waited)
+	}
+	for _, record := range logs.records {
+		if record.Level >= slog.LevelWarn && record.Message != "TO1 failed" {
+			t.Errorf("unexpected log for a delay-only directive: %s", record.Message)
+		}
+	}
+	if n := onboardMetrics.To1Attempts; n != 1 {
+		t.Errorf("expected a single TO1 attempt, got %d", n)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for range 100 {
+		if d := jitter(time.Minute); d < 45*time.Second || d > 75*time.Second {
+			t.Fatalf("expected 1m within 25%%, got %s", d)
+		}
+	}
+	if d := jitter(0); d != 0 {
+		t.Errorf("expected no delay to stay 0, got %s", d)
+	}
+}
+
+// recordHandler is a slog handler which keeps every record.
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, record slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, record)
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordHandler) WithGroup(string) slog.Handler { return h }
+
+func TestInitializeFSIMsSkipCommand(t *testing.T) {
+	defer func(echo bool, skip modulesVar) { echoCmds, skipFsims = echo, skip }(echoCmds, skipFsims)
+	echoCmds = true
+
+	for _, test := range []struct {
+		skip modulesVar
+		want []string
+	}{
+		{want: []string{"fdo.command", "fido_alliance"}},
+		{skip: modulesVar{"fdo.command"}, want: []string{"fido_alliance"}},
+	} {
+		skipFsims = test.skip
+		if got := moduleNames(initializeFSIMs()); !slices.Equal(got, test.want) {
+			t.Errorf("-skip-fsim %s: expected modules %q, got %q", test.skip.String(), test.want, got)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// gzipFS serves a request for "name.gz" which does not exist as the gzip
+// compressed content of "name", for -upload-compress.
+//
+// fdo.upload sends the length of a file before its content, so the content is
+// compressed twice: once to count the compressed length and again while it is
+// read. The output of gzip is deterministic, so both passes match, and the
+// file is never held in memory or written to disk in full. Only the bytes
+// present when the file was opened are sent, so a growing log still matches
+// its length.
+type gzipFS struct {
+	fs.FS
+}
+
+func (g gzipFS) Open(name string) (fs.File, error) {
+	f, err := g.FS.Open(name)
+	base, compressed := strings.CutSuffix(name, ".gz")
+	if err == nil || !compressed || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	src, srcErr := g.FS.Open(base)
+	if srcErr != nil {
+		return nil, err
+	}
+	info, err := src.Stat()
+	if err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+
+	counter := &countingWriter{}
+	if err := gzipCopy(counter, src, info.Size()); err != nil {
+		_ = src.Close()
+		return nil, fmt.Errorf("error compressing %q: %w", base, err)
+	}
+	_ = src.Close()
+
+	if src, err = g.FS.Open(base); err != nil {
+		return nil, err
+	}
+	return &gzipFile{
+		src:  src,
+		size: info.Size(),
+		info: gzipInfo{FileInfo: info, name: info.Name() + ".gz", size: counter.n},
+	}, nil
+}
+
+// gzipCopy writes the gzip compressed first size bytes of src to dst.
+func gzipCopy(dst io.Writer, src io.Reader, size int64) error {
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, io.LimitReader(src, size)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// gzipFile compresses its source on demand as it is read.
+type gzipFile struct {
+	src  fs.File
+	size int64
+	info gzipInfo
+	pr   *io.PipeReader
+}
+
+func (f *gzipFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// Name returns the path of the source file with .gz appended, if known.
+func (f *gzipFile) Name() string {
+	if named, ok := f.src.(interface{ Name() string }); ok {
+		return named.Name() + ".gz"
+	}
+	return f.info.Name()
+}
+
+func (f *gzipFile) Read(p []byte) (int, error) {
+	if f.pr == nil {
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(gzipCopy(pw, f.src, f.size)) }()
+		f.pr = pr
+	}
+	return f.pr.Read(p)
+}
+
+func (f *gzipFile) Close() error {
+	if f.pr != nil {
+		_ = f.pr.Close()
+	}
+	return f.src.Close()
+}
+
+// gzipInfo reports the name and compressed size of a gzipFile.
+type gzipInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i gzipInfo) Name() string { return i.name }
+func (i gzipInfo) Size() int64  { return i.size }
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
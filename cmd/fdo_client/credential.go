@@ -13,9 +13,12 @@ import (
 	"flag"
 	"fmt"
 	"hash"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 
 	"github.com/fido-device-onboard/go-fdo"
 	tpmnv "github.com/fido-device-onboard/go-fdo-client/internal/tpm_utils"
@@ -50,7 +53,7 @@ type fdoTpmDeviceCredential struct {
 }
 
 func tpmCred() (hash.Hash, hash.Hash, crypto.Signer, func() error, error) {
-	var diKeyFlagSet bool
+	diKeyFlagSet := diKeyType != ""
 	clientFlags.Visit(func(flag *flag.Flag) {
 		if flag == nil {
 			slog.Error("Unexpected nil flag encountered")
@@ -116,10 +119,24 @@ func readCred() (_ *fdo.DeviceCredential, hmacSha256, hmacSha384 hash.Hash, key
 		return &dc.DC.DeviceCredential, hmacSha256, hmacSha384, key, cleanup, nil
 	}
 
+	if pkcs11Module != "" {
+		var dc fdoPkcs11DeviceCredential
+		if err := readCredFile(&dc); err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+
+		hmacSha256, hmacSha384, key, err := pkcs11Cred(false)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		return &dc.DC, hmacSha256, hmacSha384, key, nil, nil
+	}
+
 	var dc fdoDeviceCredential
 	if err := readCredFile(&dc); err != nil {
 		return nil, nil, nil, nil, nil, err
 	}
+	to2HmacSecret = dc.DC.HmacSecret
 	return &dc.DC.DeviceCredential,
 		hmac.New(sha256.New, dc.DC.HmacSecret),
 		hmac.New(sha512.New384, dc.DC.HmacSecret),
@@ -167,11 +184,56 @@ func readCredFile(v any) error {
 	if err != nil {
 		return fmt.Errorf("error reading blob credential %q: %w", blobPath, err)
 	}
-	if err := cbor.Unmarshal(blobData, v); err != nil {
+	if isEncryptedBlob(blobData) {
+		if blobData, err = decryptBlob(blobData); err != nil {
+			return fmt.Errorf("error reading blob credential %q: %w", blobPath, err)
+		}
+		blobEncrypted = true
+	}
+	if isCompressedBlob(blobData) {
+		if blobData, err = decompressBlob(blobData); err != nil {
+			return fmt.Errorf("error reading blob credential %q: %w", blobPath, err)
+		}
+		blobCompressed = true
+	}
+	if dc, ok := v.(*fdoDeviceCredential); ok && splitSecrets() {
+		err = unmarshalSplitCred(blobData, dc)
+	} else {
+		err = cbor.Unmarshal(blobData, v)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing blob credential %q: %w", blobPath, err)
+	}
+	if err := checkCredVersion(v); err != nil {
 		return fmt.Errorf("error parsing blob credential %q: %w", blobPath, err)
 	}
 	if printDevice {
-		fmt.Printf("%+v\n", v)
+		printCred(v)
+	}
+	return nil
+}
+
+// supportedCredVersions are the FDO protocol versions of device credentials
+// this client can onboard with.
+var supportedCredVersions = []uint16{101}
+
+// checkCredVersion returns an error if a decoded credential is of an
+// unsupported protocol version, which usually means the file is not a device
+// credential or was written by an incompatible client.
+func checkCredVersion(v any) error {
+	var version uint16
+	switch dc := v.(type) {
+	case *fdoDeviceCredential:
+		version = dc.DC.Version
+	case *fdoTpmDeviceCredential:
+		version = dc.DC.Version
+	case *fdoPkcs11DeviceCredential:
+		version = dc.DC.Version
+	default:
+		return nil
+	}
+	if !slices.Contains(supportedCredVersions, version) {
+		return fmt.Errorf("unsupported credential version %d (supported versions: %v)", version, supportedCredVersions)
 	}
 	return nil
 }
@@ -187,6 +249,16 @@ func updateCred(newDC fdo.DeviceCredential, state FdoDeviceState) error {
 		return saveTpmCred(dc)
 	}
 
+	if pkcs11Module != "" {
+		var dc fdoPkcs11DeviceCredential
+		if err := readCredFile(&dc); err != nil {
+			return err
+		}
+		dc.DC = newDC
+		dc.State = state
+		return saveCred(dc)
+	}
+
 	var dc fdoDeviceCredential
 	if err := readCredFile(&dc); err != nil {
 		return err
@@ -197,28 +269,34 @@ func updateCred(newDC fdo.DeviceCredential, state FdoDeviceState) error {
 }
 
 func saveCred(dc any) error {
-	// Encode device credential to temp file
-	tmp, err := os.CreateTemp(".", "fdo_cred_*")
-	if err != nil {
-		return fmt.Errorf("error creating temp file for device credential: %w", err)
+	if cred, ok := dc.(fdoDeviceCredential); ok && splitSecrets() {
+		split, err := splitCred(cred)
+		if err != nil {
+			return err
+		}
+		dc = split
 	}
-	defer func() { _ = tmp.Close() }()
 
-	if err := cbor.NewEncoder(tmp).Encode(dc); err != nil {
+	data, err := cbor.Marshal(dc)
+	if err != nil {
 		return err
 	}
-
-	// Ensure the temp file is closed before renaming
-	if err := tmp.Close(); err != nil {
-		return fmt.Errorf("error closing temp file: %w", err)
+	if blobCompress || blobCompressed {
+		if data, err = compressBlob(data); err != nil {
+			return err
+		}
 	}
-
-	// Rename temp file to given blob path
-	if err := os.Rename(tmp.Name(), blobPath); err != nil {
-		return fmt.Errorf("error renaming temp blob credential to %q: %w", blobPath, err)
+	if blobEncrypt || blobEncrypted {
+		if data, err = encryptBlob(data); err != nil {
+			return err
+		}
 	}
-
-	return nil
+	return writeFileAtomic(blobPath, 0o600, func(w io.Writer) error {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("error writing temp file for device credential: %w", err)
+		}
+		return nil
+	})
 }
 
 // readTpmCred reads the stored credential from TPM NV memory.
@@ -234,9 +312,12 @@ func readTpmCred(v any) error {
 	if err := cbor.Unmarshal(data, v); err != nil {
 		return fmt.Errorf("error parsing credential: %w", err)
 	}
+	if err := checkCredVersion(v); err != nil {
+		return fmt.Errorf("error parsing credential: %w", err)
+	}
 
 	if printDevice {
-		fmt.Printf("%+v\n", v)
+		printCred(v)
 	}
 	return nil
 }
@@ -261,6 +342,31 @@ func saveTpmCred(dc any) error {
 		return fmt.Errorf("failed to write to NV: %w", err)
 	}
 
+	if skipNVVerify {
+		return nil
+	}
+	return verifyTpmCred(dc, data)
+}
+
+// verifyTpmCred reads back the credential written to TPM NV memory and checks
+// that it decodes to the same credential, so that a partial or failed write is
+// reported instead of leaving a corrupt credential on the device.
+func verifyTpmCred(dc any, written []byte) error {
+	data, err := tpmnv.TpmNVRead(tpmc, tpm2.TPMHandle(FDO_CRED_NV_IDX))
+	if err != nil {
+		return fmt.Errorf("error verifying credential in NV: %w", err)
+	}
+	readBack := reflect.New(reflect.TypeOf(dc))
+	if err := cbor.Unmarshal(data, readBack.Interface()); err != nil {
+		return fmt.Errorf("error verifying credential in NV: decoding: %w", err)
+	}
+	reencoded, err := cbor.Marshal(readBack.Elem().Interface())
+	if err != nil {
+		return fmt.Errorf("error verifying credential in NV: encoding: %w", err)
+	}
+	if !bytes.Equal(reencoded, written) {
+		return fmt.Errorf("error verifying credential in NV: read back %d bytes which differ from the %d bytes written", len(data), len(written))
+	}
 	return nil
 }
 
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDeviceInfoLen limits the DeviceInfo sent in DI. FDO types it as a text
+// string without a maximum length, so the limit only guards against values
+// owner policies and voucher tools are unlikely to handle.
+const maxDeviceInfoLen = 255
+
+// setDIDeviceInfo sets the DeviceInfo of DI from -di-model and -di-firmware as
+// "model=<model>;firmware=<version>", omitting a part which is not given, so
+// that owner policy can parse it. -di-device-info gives DeviceInfo as is and
+// cannot be combined with them.
+func setDIDeviceInfo() error {
+	if diModel != "" || diFirmware != "" {
+		var rawSet bool
+		clientFlags.Visit(func(f *flag.Flag) { rawSet = rawSet || f.Name == "di-device-info" })
+		if rawSet {
+			return fmt.Errorf("-di-device-info cannot be combined with -di-model or -di-firmware")
+		}
+
+		var parts []string
+		for _, field := range []struct{ key, value string }{
+			{"model", diModel},
+			{"firmware", diFirmware},
+		} {
+			if field.value == "" {
+				continue
+			}
+			if strings.ContainsAny(field.value, ";=") {
+				return fmt.Errorf("invalid DI %s %q: must not contain ; or =", field.key, field.value)
+			}
+			parts = append(parts, field.key+"="+field.value)
+		}
+		diDeviceInfo = strings.Join(parts, ";")
+	}
+
+	switch {
+	case diDeviceInfo == "":
+		return fmt.Errorf("invalid DI device info: must not be empty")
+	case !utf8.ValidString(diDeviceInfo):
+		return fmt.Errorf("invalid DI device info %q: must be UTF-8", diDeviceInfo)
+	case len(diDeviceInfo) > maxDeviceInfoLen:
+		return fmt.Errorf("invalid DI device info: %d bytes is longer than %d", len(diDeviceInfo), maxDeviceInfoLen)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// Known values of -devmod-os and -devmod-arch, as listed by go tool dist list.
+var (
+	knownDevmodOS = []string{"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js",
+		"linux", "netbsd", "openbsd", "plan9", "solaris", "wasip1", "windows"}
+	knownDevmodArch = []string{"386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le",
+		"mipsle", "ppc64", "ppc64le", "riscv64", "s390x", "wasm"}
+)
+
+// deviceDevmod returns the devmod service info sent to the owner in TO2. The
+// os, arch and bin of the client are replaced by -devmod-os and -devmod-arch
+// when provisioning on behalf of another device.
+func deviceDevmod() serviceinfo.Devmod {
+	goos, goarch := runtime.GOOS, runtime.GOARCH
+	if devmodOS != "" {
+		goos = devmodOS
+	}
+	if devmodArch != "" {
+		goarch = devmodArch
+	}
+	return serviceinfo.Devmod{
+		Os:      goos,
+		Arch:    goarch,
+		Version: "Debian Bookworm",
+		Device:  "go-validation",
+		FileSep: ";",
+		Bin:     goarch,
+	}
+}
+
+// printDevmod prints the devmod and the modules which would be advertised in
+// TO2, for -print-devmod, as JSON with -log-format json and as text otherwise.
+func printDevmod() error {
+	devmod := deviceDevmod()
+	modules := moduleNames(initializeFSIMs())
+
+	if logFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Os      string   `json:"os"`
+			Arch    string   `json:"arch"`
+			Version string   `json:"version"`
+			Device  string   `json:"device"`
+			Serial  []byte   `json:"sn,omitempty"`
+			PathSep string   `json:"pathsep,omitempty"`
+			FileSep string   `json:"sep"`
+			Newline string   `json:"nl,omitempty"`
+			Temp    string   `json:"tmp,omitempty"`
+			Dir     string   `json:"dir,omitempty"`
+			ProgEnv string   `json:"progenv,omitempty"`
+			Bin     string   `json:"bin"`
+			MudURL  string   `json:"mudurl,omitempty"`
+			Modules []string `json:"modules"`
+		}{
+			devmod.Os, devmod.Arch, devmod.Version, devmod.Device, devmod.Serial,
+			devmod.PathSep, devmod.FileSep, devmod.Newline, devmod.Temp, devmod.Dir,
+			devmod.ProgEnv, devmod.Bin, devmod.MudURL, modules,
+		})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "devmod[\n")
+	for _, field := range []struct{ name, value string }{
+		{"os", devmod.Os},
+		{"arch", devmod.Arch},
+		{"version", devmod.Version},
+		{"device", devmod.Device},
+		{"sn", string(devmod.Serial)},
+		{"pathsep", devmod.PathSep},
+		{"sep", devmod.FileSep},
+		{"nl", devmod.Newline},
+		{"tmp", devmod.Temp},
+		{"dir", devmod.Dir},
+		{"progenv", devmod.ProgEnv},
+		{"bin", devmod.Bin},
+		{"mudurl", devmod.MudURL},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&b, "  %-10s %q\n", field.name, field.value)
+		}
+	}
+	fmt.Fprintf(&b, "  %-10s %s\n]\n", "modules", strings.Join(modules, ", "))
+	_, err := fmt.Print(b.String())
+	return err
+}
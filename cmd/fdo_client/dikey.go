@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// setDIKey sets -di-key from -di-key-type with -di-key-curve for EC keys or
+// -di-key-size for RSA keys, which default to P-384 and 2048 bits. The FDO key
+// types only cover the curves and sizes of the -di-key names, so others are
+// rejected rather than mapped to the nearest supported key.
+//
+// -di-key-type takes precedence over the key type of a DI manifest, but not
+// -di-key given on the command line, as the two conflict.
+func setDIKey() error {
+	if diKeyType == "" {
+		if diKeyCurve != "" || diKeySize != 0 {
+			return fmt.Errorf("-di-key-curve and -di-key-size require -di-key-type")
+		}
+	} else {
+		if givenFlags["di-key"] {
+			return fmt.Errorf("-di-key cannot be combined with -di-key-type")
+		}
+
+		switch diKeyType {
+		case "ec":
+			if diKeySize != 0 {
+				return fmt.Errorf("-di-key-size applies to RSA keys, use -di-key-curve for EC keys")
+			}
+			switch strings.ToUpper(strings.ReplaceAll(diKeyCurve, "-", "")) {
+			case "P256":
+				diKey = "ec256"
+			case "P384", "":
+				diKey = "ec384"
+			case "P521":
+				return fmt.Errorf("unsupported DI key curve %s: FDO device keys use P-256 or P-384", diKeyCurve)
+			default:
+				return fmt.Errorf("invalid DI key curve: %s", diKeyCurve)
+			}
+		case "rsa":
+			if diKeyCurve != "" {
+				return fmt.Errorf("-di-key-curve applies to EC keys, use -di-key-size for RSA keys")
+			}
+			switch diKeySize {
+			case 2048, 0:
+				diKey = "rsa2048"
+			case 3072:
+				diKey = "rsa3072"
+			default:
+				return fmt.Errorf("unsupported DI key size %d: FDO device keys use RSA 2048 or 3072", diKeySize)
+			}
+		default:
+			return fmt.Errorf("invalid DI key type: %s", diKeyType)
+		}
+	}
+
+	if tpmPath == "simulator" && diKey == "rsa3072" {
+		return fmt.Errorf("the TPM simulator does not support RSA 3072 keys, use rsa2048 or an EC key")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mode and ownership applied to files received by fdo.download, parsed from
+// -download-mode and -download-owner by validateFlags. A uid or gid of -1
+// leaves it unchanged.
+var (
+	dlFileMode os.FileMode = 0o600
+	dlUID                  = -1
+	dlGID                  = -1
+)
+
+// parseFileMode parses an octal file permission mode, such as 0644.
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode: %s", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseDownloadOwner parses a "user:group" owner, where either name may be
+// empty to leave it unchanged or a numeric ID.
+func parseDownloadOwner(s string) (uid, gid int, err error) {
+	userName, groupName, _ := strings.Cut(s, ":")
+	uid, gid = -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("unknown download owner user: %s", userName)
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("download owner is not supported on this platform")
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown download owner group: %s", groupName)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("download owner is not supported on this platform")
+		}
+	}
+	return uid, gid, nil
+}
+
+// downloadPath returns the path below dir of a file name sent by the owner to
+// fdo.download or fdo.wget. Absolute names and names which would leave dir,
+// such as ../name, are rejected, as is a name of dir itself.
+func downloadPath(dir, name string) (string, error) {
+	if !filepath.IsLocal(name) || filepath.Clean(name) == "." {
+		return "", fmt.Errorf("file name %q is not below %s", name, dir)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// createDownloadTemp creates a temp file for fdo.download in dir with the
+// configured mode and ownership, which the file keeps when it is renamed to
+// its final path.
+func createDownloadTemp(dir string) (*os.File, error) {
+	tmpFile, err := os.CreateTemp(dir, ".fdo.download_*")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpFile.Chmod(dlFileMode); err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return nil, fmt.Errorf("error setting mode of download: %w", err)
+	}
+	if dlUID != -1 || dlGID != -1 {
+		if err := tmpFile.Chown(dlUID, dlGID); err != nil {
+			_ = tmpFile.Close()
+			_ = os.Remove(tmpFile.Name())
+			return nil, fmt.Errorf("error setting owner of download: %w", err)
+		}
+	}
+	return tmpFile, nil
+}
@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/fsim"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+func TestDownloadPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{name: "file.txt", want: filepath.Join(dir, "file.txt")},
+		{name: "sub/file.txt", want: filepath.Join(dir, "sub", "file.txt")},
+		{name: "sub/../file.txt", want: filepath.Join(dir, "file.txt")},
+		{name: "../file.txt"},
+		{name: "../../etc/x"},
+		{name: "sub/../../file.txt"},
+		{name: "/etc/passwd"},
+		{name: "."},
+		{name: ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := downloadPath(dir, test.name)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("expected %q to be rejected, got %q", test.name, path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path != test.want {
+				t.Errorf("expected %q, got %q", test.want, path)
+			}
+		})
+	}
+}
+
+func TestDownloadNameToPathRejectsTraversal(t *testing.T) {
+	defer func(dir string, interval time.Duration) {
+		dlDir, progressInterval, downloads = dir, interval, nil
+	}(dlDir, progressInterval)
+	dlDir, progressInterval, downloads = t.TempDir(), 0, nil
+
+	recorder, ok := initializeFSIMs()["fdo.download"].(*downloadRecorder)
+	if !ok {
+		t.Fatal("fdo.download not enabled by -download")
+	}
+	download := recorder.DeviceModule.(*fsim.Download)
+	for _, name := range []string{"../../etc/x", "/etc/x"} {
+		if path := download.NameToPath(name); path != "" {
+			t.Errorf("expected %q to be rejected, got %q", name, path)
+		}
+	}
+	if len(downloads) != 0 {
+		t.Errorf("rejected names recorded as downloads: %v", downloads)
+	}
+	if path := download.NameToPath("file.txt"); path != filepath.Join(dlDir, "file.txt") {
+		t.Errorf("expected file.txt below %s, got %q", dlDir, path)
+	}
+}
+
+func TestCheckWorkingDirsRelative(t *testing.T) {
+	defer func(dl, wget string) { dlDir, wgetDir = dl, wget }(dlDir, wgetDir)
+
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "downloads"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(base); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(cwd) }()
+	// The temp dir may be reached through a symlink, as on macOS
+	if base, err = os.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	abs := t.TempDir()
+	for _, test := range []struct {
+		dir, want string
+	}{
+		{dir: "downloads", want: filepath.Join(base, "downloads")},
+		{dir: "./downloads/", want: filepath.Join(base, "downloads")},
+		{dir: abs, want: abs},
+	} {
+		dlDir, wgetDir = test.dir, ""
+		if err := checkWorkingDirs(); err != nil {
+			t.Fatalf("%s: %v", test.dir, err)
+		}
+		if dlDir != test.want {
+			t.Errorf("%s: expected %q, got %q", test.dir, test.want, dlDir)
+		}
+	}
+
+	dlDir, wgetDir = "missing", ""
+	if err := checkWorkingDirs(); err == nil {
+		t.Error("expected a missing relative download dir to be rejected")
+	}
+}
+
+func TestDownloadTempRenameKeepsModeAndTimes(t *testing.T) {
+	defer func(mode os.FileMode) { dlFileMode = mode }(dlFileMode)
+	dlFileMode = 0o640
+
+	dir := t.TempDir()
+	tmpFile, err := createDownloadTemp(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(tmpFile.Name()) != dir {
+		t.Fatalf("temp file %q not created in %s, so the rename may cross filesystems", tmpFile.Name(), dir)
+	}
+	if _, err := tmpFile.WriteString("contents"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(tmpFile.Name(), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// fsim.Download renames the temp file to the path from NameToPath
+	path, err := downloadPath(dir, "sub.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != dlFileMode {
+		t.Errorf("expected mode %v, got %v", dlFileMode, info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("expected mtime %v, got %v", mtime, info.ModTime())
+	}
+}
+
+// sendDownload sends a file to fdo.download as the owner would, with the
+// given SHA-384 checksum if not nil.
+func sendDownload(t *testing.T, module serviceinfo.DeviceModule, name string, data, sha384 []byte) {
+	t.Helper()
+	ctx := context.Background()
+	respond := func(string) io.Writer { return io.Discard }
+	send := func(messageName string, v any) {
+		var body bytes.Buffer
+		if err := cbor.NewEncoder(&body).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if err := module.Receive(ctx, messageName, &body, respond, func() {}); err != nil {
+			t.Fatalf("%s: %v", messageName, err)
+		}
+	}
+	send("length", len(data))
+	if sha384 != nil {
+		send("sha-384", sha384)
+	}
+	send("name", name)
+	send("data", data)
+}
+
+func TestDownloadRecordedAfterRename(t *testing.T) {
+	defer func(dir string, interval time.Duration) {
+		dlDir, progressInterval, downloads = dir, interval, nil
+	}(dlDir, progressInterval)
+	dlDir, progressInterval, downloads = t.TempDir(), 0, nil
+
+	module := initializeFSIMs()["fdo.download"]
+	if err := module.Transition(true); err != nil {
+		t.Fatal(err)
+	}
+	sendDownload(t, module, "good.txt", []byte("good"), nil)
+	if want := []string{filepath.Join(dlDir, "good.txt")}; !slices.Equal(downloads, want) {
+		t.Fatalf("expected downloads %v, got %v", want, downloads)
+	}
+
+	// A stale file of an earlier run must not be passed to the hook when its
+	// download fails
+	stale := filepath.Join(dlDir, "stale.txt")
+	if err := os.WriteFile(stale, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sendDownload(t, module, "stale.txt", []byte("new"), make([]byte, 48))
+	if len(downloads) != 1 {
+		t.Errorf("failed download recorded: %v", downloads)
+	}
+	if data, err := os.ReadFile(stale); err != nil || string(data) != "old" {
+		t.Errorf("stale file changed: %q, %v", data, err)
+	}
+}
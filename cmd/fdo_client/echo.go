@@ -0,0 +1,32 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// recordCommand appends a command received by fdo.command to the
+// -echo-commands-file transcript, one timestamped command per line.
+func recordCommand(name string, args []string) {
+	f, err := os.OpenFile(filepath.Clean(echoCmdsFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		slog.Error("Recording command failed", "path", echoCmdsFile, "error", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{name}, args...) {
+		quoted = append(quoted, fmt.Sprintf("%q", arg))
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", time.Now().UTC().Format(time.RFC3339), strings.Join(quoted, " ")); err != nil {
+		slog.Error("Recording command failed", "path", echoCmdsFile, "error", err)
+	}
+}
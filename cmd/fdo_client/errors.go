@@ -0,0 +1,273 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// ServiceInfoError is returned by transferOwnership2 when TO2 fails during the
+// service info exchange, so that callers may use errors.As to distinguish
+// module failures from other protocol failures. Its message is that of the
+// wrapped error.
+type ServiceInfoError struct {
+	// Module is the name of the service info module which failed, if known.
+	Module string
+
+	// MsgType is the TO2 message type being processed when the failure
+	// occurred.
+	MsgType uint8
+
+	// Code is the FDO error code reported by the owner, or zero if the owner
+	// did not send an error message.
+	Code uint16
+
+	Err error
+}
+
+func (e *ServiceInfoError) Error() string { return e.Err.Error() }
+
+func (e *ServiceInfoError) Unwrap() error { return e.Err }
+
+// serviceInfoError wraps a TO2 error in a ServiceInfoError if it occurred
+// during the service info exchange, otherwise it returns err unchanged.
+func serviceInfoError(err error, failedModule string) error {
+	if err == nil {
+		return nil
+	}
+	var errMsg protocol.ErrorMessage
+	if errors.As(err, &errMsg) {
+		switch errMsg.PrevMsgType {
+		case protocol.TO2DeviceServiceInfoReadyMsgType, protocol.TO2DeviceServiceInfoMsgType:
+			return &ServiceInfoError{Module: failedModule, MsgType: errMsg.PrevMsgType, Code: errMsg.Code, Err: err}
+		}
+	}
+	if failedModule != "" {
+		return &ServiceInfoError{Module: failedModule, MsgType: protocol.TO2OwnerServiceInfoMsgType, Err: err}
+	}
+	return err
+}
+
+// clockSkewError adds a hint to a TLS certificate verification failure caused
+// by a certificate which has expired or is not yet valid, which on devices
+// without a battery backed RTC usually means the clock has not been set.
+func clockSkewError(err error) error {
+	var certErr x509.CertificateInvalidError
+	if err == nil || !errors.As(err, &certErr) || certErr.Reason != x509.Expired {
+		return err
+	}
+	return fmt.Errorf("device clock may be incorrect: current time is %s; check NTP/RTC, or use -insecure-skip-cert-time: %w",
+		time.Now().UTC().Format(time.RFC3339), err)
+}
+
+// kexOwnerKeys is the owner key type each key exchange suite may be used with
+// by a device with an EC key.
+var kexOwnerKeys = map[kex.Suite]string{
+	kex.DHKEXid14Suite:   "RSA2048",
+	kex.DHKEXid15Suite:   "RSA3072",
+	kex.ASYMKEX2048Suite: "RSA2048",
+	kex.ASYMKEX3072Suite: "RSA3072",
+	kex.ECDH256Suite:     "SECP256R1 or SECP384R1",
+	kex.ECDH384Suite:     "SECP256R1 or SECP384R1",
+}
+
+// suiteError explains a TO2 error caused by the owner not supporting the key
+// exchange or cipher suite offered by the device, otherwise it returns err
+// unchanged. The owner does not report the suites it supports, so only the
+// offered suites can be included.
+func suiteError(err error, conf fdo.TO2Config) error {
+	if err == nil {
+		return nil
+	}
+	var errMsg protocol.ErrorMessage
+	switch {
+	case errors.As(err, &errMsg) && errMsg.PrevMsgType == protocol.TO2HelloDeviceMsgType &&
+		errMsg.Code != protocol.ResourceNotFound:
+		return fmt.Errorf("owner rejected TO2.HelloDevice, it may not support the offered suites (-kex %s, -cipher %s): %w",
+			conf.KeyExchange, conf.CipherSuite, err)
+	case strings.Contains(err.Error(), "is invalid for the device and owner attestation types"):
+		return fmt.Errorf("owner does not support -kex %s, which requires a %s owner key (offered -cipher %s): %w",
+			conf.KeyExchange, kexOwnerKeys[conf.KeyExchange], conf.CipherSuite, err)
+	}
+	return err
+}
+
+// trackedModule records the name of a device module when it returns an error.
+type trackedModule struct {
+	serviceinfo.DeviceModule
+	name   string
+	failed *string
+}
+
+// trackModules wraps each module to record the name of the first one to fail
+// in failed.
+func trackModules(fsims map[string]serviceinfo.DeviceModule, failed *string) map[string]serviceinfo.DeviceModule {
+	tracked := make(map[string]serviceinfo.DeviceModule, len(fsims))
+	for name, mod := range fsims {
+		tracked[name] = &trackedModule{DeviceModule: mod, name: name, failed: failed}
+	}
+	return tracked
+}
+
+func (m *trackedModule) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	if messageName != "data" {
+		recordEvent(reportEvent{Event: "FSIM message", Module: m.name, Detail: messageName}, nil)
+	}
+	return m.record(m.DeviceModule.Receive(ctx, messageName, messageBody, respond, yield))
+}
+
+func (m *trackedModule) Yield(ctx context.Context, respond func(string) io.Writer, yield func()) error {
+	return m.record(m.DeviceModule.Yield(ctx, respond, yield))
+}
+
+func (m *trackedModule) record(err error) error {
+	if err != nil {
+		recordEvent(reportEvent{Event: "FSIM error", Module: m.name}, err)
+		recordFSIMError(m.name)
+	}
+	if err != nil && *m.failed == "" {
+		*m.failed = m.name
+	}
+	return err
+}
+
+// Onboarding failures with their own exit codes, see main.
+var (
+	errNoRvInfo  = errors.New("no usable RV info")
+	errTO1Failed = errors.New("TO1 failed on all RV URLs")
+	errTO2Failed = errors.New("TO2 failed on all owner URLs")
+	errCredSave  = errors.New("error saving device credential")
+)
+
+// errAlreadyOnboarded is returned for a device in the idle state when
+// -require-onboard is set.
+var errAlreadyOnboarded = errors.New("device has already been onboarded")
+
+// errDeadline is the cause of the context of a run exceeding -deadline.
+var errDeadline = errors.New("onboarding deadline exceeded")
+
+// ctxError returns the error for a run stopped by its context, which is
+// either -deadline being exceeded or the user interrupting the client.
+func ctxError(ctx context.Context) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errDeadline) {
+		return fmt.Errorf("%w after %s", errDeadline, deadline)
+	}
+	return fmt.Errorf("onboarding interrupted: %w", ctx.Err())
+}
+
+// Failures which the go-fdo library only reports by their message. libError
+// marks them with these where the library is called, so that they can be
+// matched with errors.Is.
+var (
+	errUnsupportedKey  = errors.New("unsupported key or key exchange")
+	errUnsupportedHash = errors.New("unsupported hash algorithm")
+	errServerStatus    = errors.New("server error (5xx) HTTP response")
+	errCSRRejected     = errors.New("CSR rejected by the server")
+)
+
+// markedError is an error of the go-fdo library which also matches the local
+// sentinel kind. Its message is that of the library error.
+type markedError struct {
+	kind error
+	err  error
+}
+
+func (e *markedError) Error() string { return e.err.Error() }
+
+func (e *markedError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// libError marks an error returned by DI, TO1, TO2 or voucher verification
+// of the go-fdo library with the sentinel of its failure, if known. Matching
+// the message is required as the library does not return typed errors for
+// these failures.
+func libError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	var errMsg protocol.ErrorMessage
+	var kind error
+	switch {
+	case errors.As(err, &errMsg) && strings.Contains(errMsg.ErrString, "CSR"):
+		kind = errCSRRejected
+	case strings.Contains(msg, "unsupported hash algorithm"):
+		kind = errUnsupportedHash
+	case strings.Contains(msg, "unsupported key type"),
+		strings.Contains(msg, "unsupported key encoding"),
+		strings.Contains(msg, "unsupported key exchange"),
+		strings.Contains(msg, "unsupported public key"):
+		kind = errUnsupportedKey
+	case strings.Contains(msg, "unexpected HTTP response code: 5"):
+		kind = errServerStatus
+	default:
+		return err
+	}
+	return &markedError{kind: kind, err: err}
+}
+
+// isTransient reports whether err is likely to be resolved by retrying, such
+// as a network failure or a server-side (5xx) error. Client (4xx) errors and
+// protocol errors reported by the server, such as a rejected CSR, are
+// permanent.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errCSRRejected) || isTLSVerifyError(err) {
+		return false
+	}
+	// The HTTP client wraps every failure in a *url.Error, which is a
+	// net.Error, so only connection failures and timeouts are matched
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) || (errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errServerStatus) {
+		return true
+	}
+	var errMsg protocol.ErrorMessage
+	return errors.As(err, &errMsg) && errMsg.Code == protocol.InternalServerErrCode
+}
+
+// isTLSVerifyError reports whether err is a failure to verify the server
+// certificate or a TLS alert sent by the server, such as for a rejected
+// client certificate, which recur on every attempt.
+func isTLSVerifyError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var alertErr tls.AlertError
+	return errors.As(err, &verifyErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) || errors.As(err, &alertErr)
+}
+
+// isPermanent reports whether an onboarding failure would recur with every
+// owner and on every retry, because the voucher is too long or fails
+// verification or a key or algorithm is not supported, for -retry-on transient.
+func isPermanent(err error) bool {
+	return errors.Is(err, fdo.ErrCryptoVerifyFailed) || errors.Is(err, errVoucherTooLong) ||
+		errors.Is(err, errUnsupportedKey) || errors.Is(err, errUnsupportedHash)
+}
+
+// reachedServer reports whether a failed request may have been received by
+// the server, i.e. the failure was not in resolving or connecting to it.
+func reachedServer(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+	var opErr *net.OpError
+	return !errors.As(err, &opErr) || opErr.Op != "dial"
+}
@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{name: "canceled", err: fmt.Errorf("error running DI: %w", context.Canceled)},
+		{name: "unexpected EOF", err: fmt.Errorf("error reading response: %w", io.ErrUnexpectedEOF), transient: true},
+		{name: "5xx response", err: errors.New("error sending message: unexpected HTTP response code: 503 Service Unavailable"), transient: true},
+		{name: "4xx response", err: errors.New("error sending message: unexpected HTTP response code: 404 Not Found")},
+		{name: "internal server error", err: protocol.ErrorMessage{Code: protocol.InternalServerErrCode, ErrString: "database unavailable"}, transient: true},
+		{name: "rejected CSR", err: protocol.ErrorMessage{Code: protocol.InternalServerErrCode, ErrString: "error signing CSR"}},
+		{name: "other", err: errors.New("server closed the connection")},
+		{name: "connection refused", err: &url.Error{Op: "Post", URL: "http://127.0.0.1:1/fdo/101/msg/10", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, transient: true},
+		{name: "DNS failure", err: &url.Error{Op: "Post", URL: "http://owner.invalid/fdo/101/msg/10", Err: &net.DNSError{Err: "server misbehaving", Name: "owner.invalid", IsTemporary: true}}, transient: true},
+		{name: "timeout", err: &url.Error{Op: "Post", URL: "http://127.0.0.1/fdo/101/msg/10", Err: context.DeadlineExceeded}, transient: true},
+		{name: "unknown authority", err: &url.Error{Op: "Post", URL: "https://127.0.0.1/fdo/101/msg/10", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}},
+		{name: "hostname mismatch", err: &url.Error{Op: "Post", URL: "https://owner.example.com/fdo/101/msg/10", Err: x509.HostnameError{Certificate: &x509.Certificate{}, Host: "owner.example.com"}}},
+		{name: "TLS alert", err: &url.Error{Op: "Post", URL: "https://127.0.0.1/fdo/101/msg/10", Err: &net.OpError{Op: "remote error", Err: tls.AlertError(42)}}},
+		{name: "other HTTP client error", err: &url.Error{Op: "Post", URL: "http://127.0.0.1/fdo/101/msg/10", Err: errors.New("stopped after 10 redirects")}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := fmt.Errorf("DI failed: %w", libError(test.err))
+			if err.Error() != "DI failed: "+test.err.Error() {
+				t.Errorf("libError changed the message to %q", err)
+			}
+			if got := isTransient(err); got != test.transient {
+				t.Errorf("expected isTransient %t, got %t", test.transient, got)
+			}
+		})
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{name: "bad signature", err: fmt.Errorf("error verifying voucher entries: %w", fdo.ErrCryptoVerifyFailed), permanent: true},
+		{name: "voucher too long", err: fmt.Errorf("%w: 300 entries", errVoucherTooLong), permanent: true},
+		{name: "key type", err: errors.New("error parsing owner key: unsupported key type: 99"), permanent: true},
+		{name: "key exchange", err: errors.New("unsupported key exchange/cipher suite"), permanent: true},
+		{name: "hash algorithm", err: errors.New("unsupported hash algorithm for hashing manufacturer public key: 99"), permanent: true},
+		{name: "5xx response", err: errors.New("error sending message: unexpected HTTP response code: 503 Service Unavailable")},
+		{name: "other", err: errors.New("owner closed the connection")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := fmt.Errorf("TO2 failed: %w", libError(test.err))
+			if got := isPermanent(err); got != test.permanent {
+				t.Errorf("expected isPermanent %t, got %t", test.permanent, got)
+			}
+		})
+	}
+}
+
+func TestVerifyEntriesError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want error
+	}{
+		{err: fdo.ErrCryptoVerifyFailed, want: errVoucherBroken},
+		{err: errors.New("unsupported hash algorithm for hashing initial previous hash of entry list: 99"), want: errVoucherHashAlg},
+	} {
+		if err := verifyEntriesError(test.err); !errors.Is(err, test.want) || !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %v, got %v", test.err, test.want, err)
+		}
+	}
+	if err := verifyEntriesError(errors.New("other")); errors.Is(err, errVoucherBroken) || errors.Is(err, errVoucherHashAlg) {
+		t.Errorf("unknown failure classified as %v", err)
+	}
+}
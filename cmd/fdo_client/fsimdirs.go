@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Subdirs of -isolate-fsims and -output-dir used by each service info module.
+const (
+	isolateDownloadDir = "download"
+	isolateWgetDir     = "wget"
+	isolateUploadDir   = "upload"
+	isolateCommandDir  = "command"
+)
+
+// commandDir is the working dir of commands run by fdo.command, or empty for
+// the working dir of the client.
+var commandDir string
+
+// setupFSIMDirs creates the dirs of -isolate-fsims or -output-dir, once the
+// flags are valid.
+func setupFSIMDirs() error {
+	switch {
+	case isolateDir != "":
+		return isolateFSIMs(isolateDir)
+	case outputDir != "":
+		return useOutputDir(outputDir)
+	}
+	return nil
+}
+
+// isolateFSIMs creates a subdir of root for each service info module which
+// uses the file system and confines the module to it.
+func isolateFSIMs(root string) error {
+	dirs := make(map[string]string)
+	for _, sub := range []string{isolateDownloadDir, isolateWgetDir, isolateUploadDir, isolateCommandDir} {
+		dir, err := filepath.Abs(filepath.Join(root, sub))
+		if err != nil {
+			return fmt.Errorf("invalid FSIM directory: %w", err)
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("error creating FSIM directory: %w", err)
+		}
+		dirs[sub] = dir
+	}
+	dlDir = dirs[isolateDownloadDir]
+	wgetDir = dirs[isolateWgetDir]
+	commandDir = dirs[isolateCommandDir]
+	return uploads.Set(dirs[isolateUploadDir])
+}
+
+// shellQuote quotes s as a single argument for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// useOutputDir sets -download and -wget-dir, where not given, to subdirs of
+// base, creating them if missing. base is checked by validateFlags.
+func useOutputDir(base string) error {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return fmt.Errorf("invalid output directory: %w", err)
+	}
+	for _, dir := range []struct {
+		flag *string
+		sub  string
+	}{
+		{&dlDir, isolateDownloadDir},
+		{&wgetDir, isolateWgetDir},
+	} {
+		if *dir.flag != "" {
+			continue
+		}
+		path := filepath.Join(base, dir.sub)
+		if err := os.MkdirAll(path, 0o700); err != nil {
+			return fmt.Errorf("error creating output subdirectory: %w", err)
+		}
+		*dir.flag = path
+	}
+	return nil
+}
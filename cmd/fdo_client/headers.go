@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	headerNameRe = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+	envRefRe     = regexp.MustCompile(`^\$[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// headersVar is the flag value of -owner-header. Each value has the form
+// "Name: Value". A value of the form $NAME is read from the environment
+// variable NAME, so that tokens do not appear in process arguments.
+type headersVar http.Header
+
+func (h headersVar) String() string {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (h headersVar) Set(header string) error {
+	name, value, ok := strings.Cut(header, ":")
+	if !ok {
+		return fmt.Errorf("[%q]: expected \"Name: Value\"", header)
+	}
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !headerNameRe.MatchString(name) {
+		return fmt.Errorf("[%q]: invalid header name", header)
+	}
+	if envRefRe.MatchString(value) {
+		env, ok := os.LookupEnv(value[1:])
+		if !ok {
+			return fmt.Errorf("[%q]: environment variable %s is not set", header, value[1:])
+		}
+		value = env
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("[%q]: invalid header value", name)
+	}
+	http.Header(h).Add(name, value)
+	return nil
+}
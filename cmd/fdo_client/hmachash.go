@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"hash"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// hmacSecretSize returns the length of the HMAC secret generated at DI, which
+// is the output size of the -hmac-hash algorithm.
+func hmacSecretSize() int {
+	if hmacHash == "sha384" {
+		return 48
+	}
+	return 32
+}
+
+// restrictHmac applies -hmac-hash to the device HMACs. FDO selects the HMAC by
+// the smaller of the device and owner key sizes, so the device key must have
+// the size of the chosen hash.
+//
+// Both HMACs are required by the protocol library, which picks one by the
+// owner public key hash of the credential, so the excluded one is replaced by
+// an HMAC which never matches and fails every HMAC the device would compute
+// with it.
+func restrictHmac(key crypto.Signer, hmacSha256, hmacSha384 hash.Hash) (hash.Hash, hash.Hash, error) {
+	if hmacHash == "auto" {
+		return hmacSha256, hmacSha384, nil
+	}
+	size, err := deviceKeyHashSize(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case hmacHash == "sha256" && size == 256:
+		return hmacSha256, disabledHmac{Hash: hmacSha384, alg: "HMAC-SHA384"}, nil
+	case hmacHash == "sha384" && size == 384:
+		return disabledHmac{Hash: hmacSha256, alg: "HMAC-SHA256"}, hmacSha384, nil
+	}
+	return nil, nil, fmt.Errorf("-hmac-hash %s requires a device key of the same strength, but the device key uses SHA%d", hmacHash, size)
+}
+
+// checkHmacHash fails before TO2 when the owner public key hash of the
+// credential selects an HMAC excluded by -hmac-hash.
+func checkHmacHash(alg protocol.HashAlg) error {
+	switch {
+	case hmacHash == "sha256" && alg == protocol.Sha384Hash,
+		hmacHash == "sha384" && alg == protocol.Sha256Hash:
+		return fmt.Errorf("-hmac-hash %s does not match the %s owner public key hash of the device credential", hmacHash, alg)
+	}
+	return nil
+}
+
+// deviceKeyHashSize returns the hash size FDO uses with a device key.
+func deviceKeyHashSize(pub crypto.PublicKey) (int, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return 256, nil
+		case elliptic.P384():
+			return 384, nil
+		}
+	case *rsa.PublicKey:
+		switch pub.Size() {
+		case 256:
+			return 256, nil
+		case 384:
+			return 384, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported device key for -hmac-hash: %T", pub)
+}
+
+// disabledHmac stands in for an HMAC excluded by -hmac-hash.
+type disabledHmac struct {
+	hash.Hash
+	alg string
+}
+
+func (h disabledHmac) Sum(b []byte) []byte { return b }
+
+func (h disabledHmac) Err() error {
+	return fmt.Errorf("%s is not allowed by -hmac-hash %s", h.alg, hmacHash)
+}
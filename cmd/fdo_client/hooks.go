@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// downloads holds the final paths of files received by fdo.download.
+var downloads []string
+
+// downloadRecorder records in downloads the final path of each file which
+// fdo.download moved into place. NameToPath is called before the temp file is
+// renamed, which may fail and leave the file of an earlier run at the path, so
+// the path is only recorded once the temp file is found there.
+type downloadRecorder struct {
+	serviceinfo.DeviceModule
+	temp    os.FileInfo
+	pending string
+}
+
+// created notes the temp file of the next download.
+func (r *downloadRecorder) created(f *os.File) {
+	if info, err := f.Stat(); err == nil {
+		r.temp = info
+	}
+}
+
+// resolved notes the final path of the current download.
+func (r *downloadRecorder) resolved(path string) { r.pending = path }
+
+func (r *downloadRecorder) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	err := r.DeviceModule.Receive(ctx, messageName, messageBody, respond, yield)
+	if r.pending != "" {
+		if info, statErr := os.Stat(r.pending); statErr == nil && r.temp != nil && os.SameFile(info, r.temp) {
+			downloads = append(downloads, r.pending)
+		}
+		r.temp, r.pending = nil, ""
+	}
+	return err
+}
+
+// downloadedFiles returns the unique paths of downloaded files which still
+// exist, in the order they were received.
+func downloadedFiles() []string {
+	var files []string
+	for _, path := range downloads {
+		if slices.Contains(files, path) {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+// runPostDownloadExec runs the -post-download-exec command once, passing the
+// downloaded file paths as arguments and in the FDO_DOWNLOADED_FILES
+// environment variable. The command is not run if no file was downloaded.
+func runPostDownloadExec(ctx context.Context) error {
+	if postDlExec == "" {
+		return nil
+	}
+	files := downloadedFiles()
+	if len(files) == 0 {
+		slog.Debug("No files downloaded, skipping post-download command")
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, postDlExec, files...) //nolint:gosec // Command is provided by the operator
+	cmd.Env = append(os.Environ(), "FDO_DOWNLOADED_FILES="+strings.Join(files, string(os.PathListSeparator)))
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+
+	slog.Info("Running post-download command", "command", postDlExec, "files", files)
+	err := cmd.Run()
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		slog.Info("post-download-exec", "output", scanner.Text())
+	}
+	if err != nil {
+		return fmt.Errorf("post-download command %q failed: %w", postDlExec, err)
+	}
+	return nil
+}
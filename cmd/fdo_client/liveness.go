@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/kex"
+)
+
+// touchLiveness sets the modification time of -liveness-file to now, creating
+// it if needed, and pings the systemd watchdog, so that a watchdog can tell
+// the client is making progress.
+func touchLiveness() {
+	if sdWatchdogInterval() > 0 {
+		sdNotify("WATCHDOG=1")
+	}
+	if livenessFile == "" {
+		return
+	}
+	now := time.Now()
+	err := os.Chtimes(livenessFile, now, now)
+	if errors.Is(err, fs.ErrNotExist) {
+		var f *os.File
+		if f, err = os.OpenFile(livenessFile, os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		slog.Debug("Updating liveness file failed", "path", livenessFile, "error", err)
+	}
+}
+
+// waitAlive waits for delay, touching the liveness file every
+// -liveness-interval and pinging the systemd watchdog as often as it requires,
+// and returns early with an error if the context is canceled.
+func waitAlive(ctx context.Context, delay time.Duration) error {
+	touchLiveness()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	interval := sdWatchdogInterval()
+	if livenessFile != "" && (interval == 0 || livenessInterval < interval) {
+		interval = livenessInterval
+	}
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-tick:
+			touchLiveness()
+		}
+	}
+}
+
+// livenessTransport touches the liveness file for each protocol message sent.
+type livenessTransport struct {
+	fdo.Transport
+}
+
+func (t livenessTransport) Send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (uint8, io.ReadCloser, error) {
+	touchLiveness()
+	return t.Transport.Send(ctx, msgType, msg, sess)
+}
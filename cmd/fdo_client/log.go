@@ -4,8 +4,12 @@
 package main
 
 import (
+	"bytes"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"sync"
 
 	"hermannm.dev/devlog"
 )
@@ -17,3 +21,73 @@ func init() {
 		Level: &level,
 	})))
 }
+
+// setLogFormat replaces the default text handler when format is "json".
+func setLogFormat(format string) {
+	if format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+			Level: &level,
+		})))
+	}
+}
+
+// addLogFlags registers -log-format and -log-level on the flag set of a
+// subcommand, which applies them with setupLogging after parsing.
+func addLogFlags(fs *flag.FlagSet) {
+	fs.StringVar(&logFormat, "log-format", "text", "Log output `format` [text,json]")
+	fs.StringVar(&logLevel, "log-level", "info", "Minimum `level` of messages to log [debug,info,warn,error]")
+}
+
+// setupLogging sets the level and handler of the default logger from
+// -log-level, or debug with -debug, and -log-format.
+func setupLogging() error {
+	if !contains([]string{"text", "json"}, logFormat) {
+		return fmt.Errorf("invalid log format: %s", logFormat)
+	}
+	if debug {
+		logLevel = "debug"
+	}
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", logLevel, err)
+	}
+	setLogFormat(logFormat)
+	return nil
+}
+
+// fsimError holds the first FSIM of a run to write to its error log or
+// return an error during TO2, for -fail-on-fsim-error. FSIMs of concurrent TO2
+// attempts may report at the same time.
+var fsimError struct {
+	mu     sync.Mutex
+	module string
+}
+
+// recordFSIMError records module as failed unless another FSIM failed first.
+func recordFSIMError(module string) {
+	fsimError.mu.Lock()
+	defer fsimError.mu.Unlock()
+	if fsimError.module == "" {
+		fsimError.module = module
+	}
+}
+
+// fsimErrorModule returns the first FSIM which failed during the run, or "".
+func fsimErrorModule() string {
+	fsimError.mu.Lock()
+	defer fsimError.mu.Unlock()
+	return fsimError.module
+}
+
+// slogErrorWriter logs each line written to it as an error of the given FSIM,
+// so that FSIM error logs go through the default slog handler.
+type slogErrorWriter struct {
+	module string
+}
+
+func (w slogErrorWriter) Write(p []byte) (int, error) {
+	recordFSIMError(w.module)
+	for _, line := range bytes.Split(bytes.TrimSpace(p), []byte("\n")) {
+		slog.Error(string(line), "module", w.module)
+	}
+	return len(p), nil
+}
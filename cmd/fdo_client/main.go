@@ -5,18 +5,32 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"net"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
+
+	"github.com/fido-device-onboard/go-fdo-client/internal/tpm_utils"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"golang.org/x/net/proxy"
 )
 
 var flags = flag.NewFlagSet("main", flag.ContinueOnError)
 
+// givenFlags holds the client flags given on the command line. A DI manifest
+// sets flags too, so flags.Visit cannot tell them apart after it is applied.
+var givenFlags = make(map[string]bool)
+
 func main() {
 	if err := flags.Parse(os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -30,25 +44,144 @@ func main() {
 			args = flags.Args()[2:]
 		}
 	}
+	if len(args) > 0 && args[0] == "voucher" {
+		if err := voucherCommand(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "voucher error: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "selftest" {
+		if err := selftestCommand(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "selftest error: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "migrate-cred" {
+		if err := migrateCredCommand(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "migrate-cred error: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
 	if err := clientFlags.Parse(args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	clientFlags.Visit(func(f *flag.Flag) { givenFlags[f.Name] = true })
 
 	if err := validateFlags(); err != nil {
 		fmt.Fprintf(os.Stderr, "Validation error: %v\n", err)
 		os.Exit(1)
 	}
+	if err := setupFSIMDirs(); err != nil {
+		fmt.Fprintf(os.Stderr, "client error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
 
-	if err := client(); err != nil {
+	run := clientEach
+	if watch {
+		run = watchBlobs
+	}
+	if statusAddr != "" {
+		run = withStatusServer(run)
+	}
+	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "client error: %v\n", err)
-		os.Exit(2)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns the documented exit code of an error.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errUsage):
+		return 1
+	case errors.Is(err, errDeadline):
+		return 3
+	case errors.Is(err, errAlreadyOnboarded):
+		return 4
+	case errors.Is(err, errNoRvInfo):
+		return 10
+	case errors.Is(err, errTO1Failed):
+		return 11
+	case errors.Is(err, errTO2Failed):
+		return 12
+	case errors.Is(err, errCredSave):
+		return 13
+	case errors.Is(err, errVoucherBroken):
+		return 20
+	case errors.Is(err, errVoucherHashAlg):
+		return 21
+	case errors.Is(err, errVoucherTooLong):
+		return 22
+	case errors.Is(err, context.Canceled):
+		return 130
 	}
+	return 2
 }
 
 func validateFlags() error {
-	if !isValidPath(blobPath) {
-		return fmt.Errorf("invalid blob path: %s", blobPath)
+	if deadline < 0 {
+		return fmt.Errorf("invalid deadline: %s", deadline)
+	}
+
+	if !contains([]string{"text", "json"}, logFormat) {
+		return fmt.Errorf("invalid log format: %s", logFormat)
+	}
+
+	if !contains([]string{"debug", "info", "warn", "error"}, logLevel) {
+		return fmt.Errorf("invalid log level: %s", logLevel)
+	}
+
+	for _, path := range blobPaths.paths {
+		if !isValidPath(path) {
+			return fmt.Errorf("invalid blob path: %s", path)
+		}
+	}
+	if tpmPath != "" && len(blobPaths.paths) > 1 {
+		return fmt.Errorf("multiple -blob values cannot be used with -tpm")
+	}
+
+	for _, file := range []struct{ name, path string }{
+		{"key", keyFile},
+		{"HMAC", hmacFile},
+	} {
+		if file.path != "" && !isValidPath(file.path) {
+			return fmt.Errorf("invalid %s file path: %s", file.name, file.path)
+		}
+	}
+	if dumpVoucher != "" && !isValidPath(dumpVoucher) {
+		return fmt.Errorf("invalid dump voucher path: %s", dumpVoucher)
+	}
+	if splitSecrets() && (tpmPath != "" || pkcs11Module != "") {
+		return fmt.Errorf("-key-file and -hmac-file cannot be used with -tpm or -pkcs11-module")
+	}
+	if splitSecrets() && len(blobPaths.paths) > 1 {
+		return fmt.Errorf("-key-file and -hmac-file cannot be used with multiple -blob values")
+	}
+	if keyFile != "" && keyFile == hmacFile {
+		return fmt.Errorf("-key-file and -hmac-file must be different files")
+	}
+
+	if watch && tpmPath != "" {
+		return fmt.Errorf("-watch cannot be used with -tpm")
+	}
+
+	if blobPass != "" && blobKeyFile != "" {
+		return fmt.Errorf("-blob-pass and -blob-keyfile are mutually exclusive")
+	}
+	if blobEncrypt && blobPass == "" && blobKeyFile == "" {
+		return fmt.Errorf("-blob-encrypt requires -blob-pass or -blob-keyfile")
+	}
+	if blobCompress && tpmPath != "" {
+		return fmt.Errorf("-blob-compress cannot be used with -tpm")
+	}
+	if blobKeyFile != "" && (!isValidPath(blobKeyFile) || !fileExists(blobKeyFile)) {
+		return fmt.Errorf("invalid blob key file: %s", blobKeyFile)
 	}
 
 	validCipherSuites := []string{
@@ -61,8 +194,52 @@ func validateFlags() error {
 		return fmt.Errorf("invalid cipher suite: %s", cipherSuite)
 	}
 
-	if dlDir != "" && (!isValidPath(dlDir) || !fileExists(dlDir)) {
-		return fmt.Errorf("invalid download directory: %s", dlDir)
+	if createDirs {
+		mode, err := parseFileMode(createDirMode)
+		if err != nil {
+			return fmt.Errorf("invalid working dir mode: %s", createDirMode)
+		}
+		if err := createWorkingDirs(mode); err != nil {
+			return err
+		}
+	}
+
+	if isolateDir != "" {
+		if dlDir != "" || wgetDir != "" || len(uploads) > 0 {
+			return fmt.Errorf("-isolate-fsims cannot be used with -download, -wget-dir or -upload")
+		}
+		if !isValidPath(isolateDir) {
+			return fmt.Errorf("invalid FSIM isolation directory: %s", isolateDir)
+		}
+	}
+
+	if outputDir != "" {
+		if isolateDir != "" {
+			return fmt.Errorf("-output-dir and -isolate-fsims are mutually exclusive")
+		}
+		if err := checkWritableDir(outputDir); err != nil {
+			return fmt.Errorf("invalid output directory: %w", err)
+		}
+	}
+
+	// Relative download dirs are resolved against the working dir of the
+	// client at startup, so that downloaded files are placed, logged and
+	// passed to -post-download-exec by absolute path
+	if err := checkWorkingDirs(); err != nil {
+		return err
+	}
+
+	var err error
+	if dlFileMode, err = parseFileMode(dlMode); err != nil {
+		return fmt.Errorf("invalid download mode: %s", dlMode)
+	}
+	if dlOwner != "" {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("-download-owner is not supported on %s", runtime.GOOS)
+		}
+		if dlUID, dlGID, err = parseDownloadOwner(dlOwner); err != nil {
+			return err
+		}
 	}
 
 	if diURL != "" {
@@ -82,24 +259,91 @@ func validateFlags() error {
 		}
 	}
 
+	if diManifestPath != "" {
+		if err := loadDIManifest(diManifestPath); err != nil {
+			return err
+		}
+	}
+
+	if diSerial != "" && !isValidSerialNumber(diSerial) {
+		return fmt.Errorf("invalid DI serial number: %q", diSerial)
+	}
+	if err := setDIDeviceInfo(); err != nil {
+		return err
+	}
+
+	if diRetries < 0 {
+		return fmt.Errorf("invalid DI retries: %d", diRetries)
+	}
+	if diRetryDelay < 0 {
+		return fmt.Errorf("invalid DI retry delay: %s", diRetryDelay)
+	}
+
+	if err := setDIKey(); err != nil {
+		return err
+	}
 	validDiKeys := []string{"ec256", "ec384", "rsa2048", "rsa3072"}
 	if !contains(validDiKeys, diKey) {
 		return fmt.Errorf("invalid DI key: %s", diKey)
 	}
 
+	if !contains([]string{"auto", "sha256", "sha384"}, hmacHash) {
+		return fmt.Errorf("invalid HMAC hash: %s", hmacHash)
+	}
+
 	validDiKeyEncs := []string{"x509", "x5chain", "cose"}
 	if !contains(validDiKeyEncs, diKeyEnc) {
 		return fmt.Errorf("invalid DI key encoding: %s", diKeyEnc)
 	}
 
+	// COSE keys are only supported for EC keys by the protocol library
+	if diKeyEnc == "cose" && !strings.HasPrefix(diKey, "ec") {
+		return fmt.Errorf("DI key encoding %s is incompatible with DI key %s", diKeyEnc, diKey)
+	}
+
+	if !contains([]string{"any", "yes", "no"}, expectReuse) {
+		return fmt.Errorf("invalid expect reuse: %s", expectReuse)
+	}
+	if !contains([]string{"all", "transient"}, retryOn) {
+		return fmt.Errorf("invalid retry on: %s", retryOn)
+	}
+	if devmodOS != "" && !contains(knownDevmodOS, devmodOS) {
+		return fmt.Errorf("invalid devmod os: %s (known: %s)", devmodOS, strings.Join(knownDevmodOS, ", "))
+	}
+	if devmodArch != "" && !contains(knownDevmodArch, devmodArch) {
+		return fmt.Errorf("invalid devmod arch: %s (known: %s)", devmodArch, strings.Join(knownDevmodArch, ", "))
+	}
+	if rateLimit < 0 {
+		return fmt.Errorf("invalid rate limit: %d", rateLimit)
+	}
+	if to2Concurrency < 1 {
+		return fmt.Errorf("invalid TO2 concurrency: %d", to2Concurrency)
+	}
+	if to2Concurrency > 1 && (tpmPath != "" || pkcs11Module != "") {
+		return fmt.Errorf("-to2-concurrency greater than 1 cannot be used with -tpm or -pkcs11-module")
+	}
+	if maxOVEntries < 1 || maxOVEntries > math.MaxUint8 {
+		return fmt.Errorf("invalid max voucher entries: %d, must be 1-%d", maxOVEntries, math.MaxUint8)
+	}
+
 	validKexSuites := []string{"DHKEXid14", "DHKEXid15", "ASYMKEX2048", "ASYMKEX3072", "ECDH256", "ECDH384"}
 	if !contains(validKexSuites, kexSuite) {
 		return fmt.Errorf("invalid key exchange suite: %s", kexSuite)
 	}
 
-	TPMDEVICES := []string{"/dev/tpm0", "/dev/tpmrm0", "simulator"}
-	if tpmPath != "" && !slices.Contains(TPMDEVICES, tpmPath) {
-		return fmt.Errorf("invalid TPM path: %s", tpmPath)
+	if tpmPath != "" {
+		if err := tpm_utils.CheckTpmPath(tpmPath); err != nil {
+			return fmt.Errorf("invalid TPM path: %w", err)
+		}
+	}
+
+	for _, name := range skipFsims {
+		if name == "devmod" {
+			return fmt.Errorf("devmod is required by FDO and cannot be skipped")
+		}
+		if !slices.Contains(knownModules(), name) {
+			return fmt.Errorf("unknown service info module for -skip-fsim: %q (known modules: %s)", name, strings.Join(knownModules(), ", "))
+		}
 	}
 
 	for path := range uploads {
@@ -112,8 +356,138 @@ func validateFlags() error {
 		}
 	}
 
-	if wgetDir != "" && (!isValidPath(wgetDir) || !fileExists(wgetDir)) {
-		return fmt.Errorf("invalid wget directory: %s", wgetDir)
+	if postDlExec != "" {
+		if _, err := exec.LookPath(postDlExec); err != nil {
+			return fmt.Errorf("invalid post-download command: %w", err)
+		}
+	}
+
+	if metricsFile != "" && !isValidPath(metricsFile) {
+		return fmt.Errorf("invalid metrics file path: %s", metricsFile)
+	}
+
+	if circuitMax < 0 {
+		return fmt.Errorf("invalid circuit threshold: %d", circuitMax)
+	}
+	if circuitWait < 0 {
+		return fmt.Errorf("invalid circuit cooldown: %s", circuitWait)
+	}
+
+	if ownerSNI != "" && !isValidHostname(ownerSNI) {
+		return fmt.Errorf("invalid Owner SNI: %s", ownerSNI)
+	}
+
+	if socks5Proxy != "" {
+		if _, _, err := parseSocks5(socks5Proxy); err != nil {
+			return err
+		}
+		if pinOwnerIP {
+			return fmt.Errorf("-pin-owner-ip cannot be used with -socks5, which resolves host names at the proxy")
+		}
+	}
+
+	if dnsServer != "" {
+		host, port, err := net.SplitHostPort(dnsServer)
+		if err != nil {
+			host, port = dnsServer, ""
+		}
+		if net.ParseIP(host) == nil && !isValidHostname(host) {
+			return fmt.Errorf("invalid DNS server: %s", dnsServer)
+		}
+		if port != "" && !isValidPort(port) {
+			return fmt.Errorf("invalid DNS server port: %s", port)
+		}
+	}
+	if dnsTimeout < 0 {
+		return fmt.Errorf("invalid DNS timeout: %s", dnsTimeout)
+	}
+
+	if sourceAddr != "" && !isLocalIP(sourceAddr) {
+		return fmt.Errorf("source address is not assigned to a local interface: %s", sourceAddr)
+	}
+
+	if to1Retries < 0 {
+		return fmt.Errorf("invalid TO1 retries: %d", to1Retries)
+	}
+	if to1RetryDelay < 0 {
+		return fmt.Errorf("invalid TO1 retry delay: %s", to1RetryDelay)
+	}
+
+	if to1Only && to2Only {
+		return fmt.Errorf("-to1-only and -to2-only are mutually exclusive")
+	}
+	if (to1Only || to2Only) && !isValidPath(to1BlobPath) {
+		return fmt.Errorf("invalid TO1 blob path: %s", to1BlobPath)
+	}
+	if to2Only && !fileExists(to1BlobPath) {
+		return fmt.Errorf("TO1 blob doesn't exist: %s", to1BlobPath)
+	}
+
+	if pkcs11Module != "" {
+		if !pkcs11Supported {
+			return errPkcs11Unsupported
+		}
+		if tpmPath != "" {
+			return fmt.Errorf("-pkcs11-module and -tpm are mutually exclusive")
+		}
+		if pkcs11Pin != "" && pkcs11PinFile != "" {
+			return fmt.Errorf("-pkcs11-pin and -pkcs11-pin-file are mutually exclusive")
+		}
+		if pkcs11PinFile != "" && !fileExists(pkcs11PinFile) {
+			return fmt.Errorf("PKCS#11 PIN file does not exist: %s", pkcs11PinFile)
+		}
+		if !fileExists(pkcs11Module) {
+			return fmt.Errorf("PKCS#11 module does not exist: %s", pkcs11Module)
+		}
+	}
+
+	if diRvInfo != "" && !fileExists(diRvInfo) {
+		return fmt.Errorf("RV info file does not exist: %s", diRvInfo)
+	}
+	if rvInfoPath != "" {
+		var err error
+		if rvInfoOverride, err = readRvInfoFile(rvInfoPath); err != nil {
+			return err
+		}
+	}
+
+	if expectGUID != "" {
+		if _, err := parseGUID(expectGUID); err != nil {
+			return err
+		}
+	}
+
+	if statusAddr != "" {
+		if _, _, err := net.SplitHostPort(statusAddr); err != nil {
+			return fmt.Errorf("invalid status address: %w", err)
+		}
+	}
+	if livenessFile != "" && !isValidPath(livenessFile) {
+		return fmt.Errorf("invalid liveness file path: %s", livenessFile)
+	}
+	if livenessInterval <= 0 {
+		return fmt.Errorf("invalid liveness interval: %s", livenessInterval)
+	}
+
+	if echoCmdsFile != "" && !isValidPath(echoCmdsFile) {
+		return fmt.Errorf("invalid echo commands file path: %s", echoCmdsFile)
+	}
+
+	if diAttest && tpmPath == "" {
+		return fmt.Errorf("-di-attest requires -tpm")
+	}
+
+	if saveVoucher != "" {
+		if !resale {
+			return fmt.Errorf("-save-voucher requires -resale")
+		}
+		if !isValidPath(saveVoucher) {
+			return fmt.Errorf("invalid save voucher path: %s", saveVoucher)
+		}
+	}
+
+	if wgetCA != "" && !fileExists(wgetCA) {
+		return fmt.Errorf("wget CA bundle does not exist: %s", wgetCA)
 	}
 
 	return nil
@@ -127,6 +501,41 @@ func isValidPath(p string) bool {
 	return err == nil && absPath != ""
 }
 
+// parseSocks5 parses a -socks5 address of the form host:port or
+// socks5://[user:pass@]host:port.
+func parseSocks5(s string) (string, *proxy.Auth, error) {
+	addr := s
+	var auth *proxy.Auth
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme != "socks5" || u.Path != "" {
+			return "", nil, fmt.Errorf("invalid SOCKS5 proxy: %s", s)
+		}
+		addr = u.Host
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || (net.ParseIP(host) == nil && !isValidHostname(host)) || !isValidPort(port) {
+		return "", nil, fmt.Errorf("invalid SOCKS5 proxy address: %s", addr)
+	}
+	return addr, auth, nil
+}
+
+// parseGUID parses a -expect-guid value of 32 hex digits, which may be
+// separated by dashes as in a UUID.
+func parseGUID(s string) (protocol.GUID, error) {
+	var guid protocol.GUID
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != len(guid) {
+		return guid, fmt.Errorf("invalid GUID: %s", s)
+	}
+	copy(guid[:], b)
+	return guid, nil
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil || !os.IsNotExist(err)
@@ -164,6 +573,37 @@ func isValidHostname(hostname string) bool {
 	return true
 }
 
+// isValidSerialNumber checks that a serial number is 1-255 printable ASCII
+// characters without whitespace, as accepted by manufacturer databases.
+func isValidSerialNumber(sn string) bool {
+	if len(sn) == 0 || len(sn) > 255 {
+		return false
+	}
+	for _, char := range sn {
+		if char <= ' ' || char > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func isLocalIP(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ifaceAddr := range ifaceAddrs {
+		if ipNet, ok := ifaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func isValidPort(port string) bool {
 	for _, char := range port {
 		if char < '0' || char > '9' {
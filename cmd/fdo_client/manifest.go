@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// diManifest is the content of a -di-manifest file, which is JSON only, for
+// example
+//
+//	{
+//	  "model": "edge-gateway",
+//	  "firmware": "1.4.2",
+//	  "serial": "SN0001",
+//	  "key_type": "ec384",
+//	  "key_enc": "x509",
+//	  "rv_info": ["protocol=https dns=rv.example.com port=8443"]
+//	}
+//
+// Every field is optional, and device_info may be given instead of model and
+// firmware. RV info directives use the same syntax as a -di-rvinfo file.
+type diManifest struct {
+	DeviceInfo *string  `json:"device_info"`
+	Model      *string  `json:"model"`
+	Firmware   *string  `json:"firmware"`
+	Serial     *string  `json:"serial"`
+	KeyType    *string  `json:"key_type"`
+	KeyEnc     *string  `json:"key_enc"`
+	RvInfo     []string `json:"rv_info"`
+}
+
+// manifestRvInfo is the RV info of -di-manifest, used when -di-rvinfo is not
+// given.
+var manifestRvInfo [][]protocol.RvInstruction
+
+// loadDIManifest reads -di-manifest and applies its values to the DI flags
+// which were not given on the command line. Unknown fields, values of the
+// wrong type and trailing data are rejected, and applied values are then
+// validated like their flags.
+func loadDIManifest(path string) error {
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		return fmt.Errorf("DI manifest %q must be JSON, YAML is not supported", path)
+	}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("error reading DI manifest %q: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var manifest diManifest
+	if err := dec.Decode(&manifest); err != nil {
+		return fmt.Errorf("error parsing DI manifest %q: %w", path, err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing DI manifest %q: unexpected data after manifest object", path)
+	}
+
+	// Setting the flags marks them as given, as -tpm requires for -di-key.
+	// Device info given on the command line in any form replaces all of the
+	// manifest's.
+	cliDeviceInfo := givenFlags["di-device-info"] || givenFlags["di-model"] || givenFlags["di-firmware"]
+	for name, value := range map[string]*string{
+		"di-device-info":   manifest.DeviceInfo,
+		"di-model":         manifest.Model,
+		"di-firmware":      manifest.Firmware,
+		"di-serial-number": manifest.Serial,
+		"di-key":           manifest.KeyType,
+		"di-key-enc":       manifest.KeyEnc,
+	} {
+		if value == nil || givenFlags[name] {
+			continue
+		}
+		if cliDeviceInfo && (name == "di-device-info" || name == "di-model" || name == "di-firmware") {
+			continue
+		}
+		if err := clientFlags.Set(name, *value); err != nil {
+			return fmt.Errorf("invalid DI manifest %q: %w", path, err)
+		}
+	}
+
+	if manifest.RvInfo != nil && !givenFlags["di-rvinfo"] {
+		rvInfo, err := parseRvInfo([]byte(strings.Join(manifest.RvInfo, "\n")))
+		if err != nil {
+			return fmt.Errorf("invalid DI manifest %q: rv_info: %w", path, err)
+		}
+		if !rvInfoUsable(rvInfo) {
+			return fmt.Errorf("invalid DI manifest %q: rv_info contains no directive with an address for the device", path)
+		}
+		manifestRvInfo = rvInfo
+	}
+	return nil
+}
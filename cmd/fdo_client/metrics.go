@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// onboardMetrics collects onboarding outcome measurements for -metrics-file.
+var onboardMetrics struct {
+	To1Duration time.Duration
+	To2Duration time.Duration
+	To1Attempts int
+	To2Attempts int
+	Uploaded    atomic.Int64
+}
+
+// writeMetrics writes onboarding metrics in the Prometheus text exposition
+// format. The file is written atomically so that the node_exporter textfile
+// collector never reads a partial file.
+func writeMetrics(path string, success bool, state FdoDeviceState) error {
+	var downloaded int64
+	for _, file := range downloadedFiles() {
+		if info, err := os.Stat(file); err == nil {
+			downloaded += info.Size()
+		}
+	}
+	retries := max(onboardMetrics.To1Attempts-1, 0) + max(onboardMetrics.To2Attempts-1, 0)
+
+	var buf bytes.Buffer
+	metric := func(name, help, typ string, value any) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	metric("fdo_onboarding_success", "Whether onboarding completed successfully.", "gauge", boolToInt(success))
+	metric("fdo_to1_duration_seconds", "Duration of TO1.", "gauge", onboardMetrics.To1Duration.Seconds())
+	metric("fdo_to2_duration_seconds", "Duration of TO2.", "gauge", onboardMetrics.To2Duration.Seconds())
+	metric("fdo_retries", "Number of TO1 and TO2 attempts beyond the first.", "gauge", retries)
+	metric("fdo_downloaded_bytes", "Bytes downloaded by service info modules.", "gauge", downloaded)
+	metric("fdo_uploaded_bytes", "Bytes uploaded by service info modules.", "gauge", onboardMetrics.Uploaded.Load())
+	metric("fdo_device_state", "Final FDO device state.", "gauge", int(state))
+	metric("fdo_metrics_timestamp_seconds", "Time the metrics were written.", "gauge", time.Now().Unix())
+
+	return writeFileAtomic(path, 0o644, func(w io.Writer) error {
+		if _, err := buf.WriteTo(w); err != nil {
+			return fmt.Errorf("error writing metrics: %w", err)
+		}
+		return nil
+	})
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// countingFS counts the bytes read from files opened by the upload FSIM.
+type countingFS struct {
+	fs.FS
+	n *atomic.Int64
+}
+
+// Each opened file is also recorded in uploadedFiles for the transfer summary.
+func (c countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	record := &transferredFile{Module: "fdo.upload", Path: name}
+	if named, ok := f.(interface{ Name() string }); ok {
+		record.Path = named.Name()
+	}
+	uploadedFiles = append(uploadedFiles, record)
+	return countingFile{File: f, n: c.n, record: record}, nil
+}
+
+type countingFile struct {
+	fs.File
+	n      *atomic.Int64
+	record *transferredFile
+}
+
+func (c countingFile) Read(p []byte) (int, error) {
+	n, err := c.File.Read(p)
+	c.n.Add(int64(n))
+	c.record.Size += int64(n)
+	return n, err
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/fido-device-onboard/go-fdo-client/internal/tpm_utils"
+	"github.com/fido-device-onboard/go-fdo/tpm"
+)
+
+// migrateCredCommand runs "fdo_client migrate-cred -to tpm [flags]", which
+// copies the credential of a blob into TPM NV memory.
+//
+// Only the fdo.DeviceCredential and state are copied. The HMAC secret and
+// private key of the blob cannot be imported, so the TPM credential uses keys
+// of the TPM and cannot pass TO2 with the voucher of the blob until the device
+// is provisioned again.
+func migrateCredCommand(args []string) error {
+	migrateFlags := flag.NewFlagSet("migrate-cred", flag.ContinueOnError)
+	to := migrateFlags.String("to", "", "Where to migrate the credential to [tpm]")
+	removeBlob := migrateFlags.Bool("remove-blob", false, "Remove the blob after the credential is written to the TPM")
+	migrateFlags.StringVar(&blobPath, "blob", "cred.bin", "File `path` of the device credential blob")
+	migrateFlags.StringVar(&blobPass, "blob-pass", "", "A `passphrase` to decrypt the blob with")
+	migrateFlags.StringVar(&blobKeyFile, "blob-keyfile", "", "A `file` to derive the blob decryption key from")
+	migrateFlags.StringVar(&tpmPath, "tpm", "/dev/tpmrm0", "Use a TPM at `path`")
+	migrateFlags.Usage = func() {
+		fmt.Fprintln(migrateFlags.Output(), "Usage: fdo_client migrate-cred -to tpm [-blob path] [-tpm path] [-remove-blob]")
+		migrateFlags.PrintDefaults()
+	}
+	addLogFlags(migrateFlags)
+	if err := migrateFlags.Parse(args); err != nil {
+		return errUsage
+	}
+	if err := setupLogging(); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if *to != "tpm" || migrateFlags.NArg() > 0 {
+		migrateFlags.Usage()
+		return errUsage
+	}
+	if err := tpm_utils.CheckTpmPath(tpmPath); err != nil {
+		return err
+	}
+
+	var dc fdoDeviceCredential
+	if err := readCredFile(&dc); err != nil {
+		return err
+	}
+	keyType, err := diKeyName(dc.DC.PrivateKey.Public())
+	if err != nil {
+		return err
+	}
+
+	if tpmc, err = tpm_utils.TpmOpen(tpmPath); err != nil {
+		return err
+	}
+	defer func() { _ = tpmc.Close() }()
+	var existing fdoTpmDeviceCredential
+	if err := readTpmCred(&existing); err == nil {
+		return fmt.Errorf("TPM already holds a device credential for GUID %x, clear its NV index first", existing.DC.GUID)
+	}
+
+	diKey = keyType
+	if err := saveTpmCred(fdoTpmDeviceCredential{
+		DC: tpm.DeviceCredential{
+			DeviceCredential: dc.DC.DeviceCredential,
+			DeviceKey:        tpm.FdoDeviceKey,
+		},
+		State: dc.State,
+	}); err != nil {
+		return fmt.Errorf("error saving device credential to TPM: %w", err)
+	}
+	fmt.Printf("Credential for GUID %x migrated to TPM %s\n", dc.DC.GUID, tpmPath)
+	fmt.Println("The HMAC secret and private key were not migrated and stay in the blob: " +
+		"TO2 with the TPM requires the device to be provisioned again with -tpm and -di-key " + keyType)
+
+	if *removeBlob {
+		if err := os.Remove(blobPath); err != nil {
+			return fmt.Errorf("error removing blob credential: %w", err)
+		}
+		fmt.Printf("Removed %s\n", blobPath)
+	}
+	return nil
+}
+
+// diKeyName returns the -di-key name of a device public key.
+func diKeyName(pub crypto.PublicKey) (string, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return "ec256", nil
+		case elliptic.P384():
+			return "ec384", nil
+		}
+	case *rsa.PublicKey:
+		switch pub.Size() {
+		case 256:
+			return "rsa2048", nil
+		case 384:
+			return "rsa3072", nil
+		}
+	}
+	return "", fmt.Errorf("unsupported device key: %T", pub)
+}
@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// blobsVar is the flag value of -blob. The default path is replaced by the
+// first path given on the command line and each further use of the flag adds
+// another credential.
+type blobsVar struct {
+	paths []string
+	set   bool
+}
+
+func (b *blobsVar) String() string {
+	if b == nil {
+		return ""
+	}
+	return strings.Join(b.paths, ",")
+}
+
+func (b *blobsVar) Set(path string) error {
+	if !b.set {
+		b.paths, b.set = nil, true
+	}
+	b.paths = append(b.paths, path)
+	return nil
+}
+
+var blobPaths = blobsVar{paths: []string{"cred.bin"}}
+
+// expandBlobPaths replaces each directory in paths with the regular *.bin files
+// it contains, in lexical order. Other files, such as the temp files of
+// writeFileAtomic or key files, are never taken for a credential. Paths
+// which do not exist are kept so that DI can create them.
+func expandBlobPaths(paths []string) ([]string, error) {
+	var expanded []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			expanded = append(expanded, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading blob directory %q: %w", path, err)
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && filepath.Ext(entry.Name()) == ".bin" {
+				expanded = append(expanded, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	return slices.Compact(expanded), nil
+}
+
+// clientEach runs the client once for each device credential blob, continuing
+// past failures, and returns an error if any device failed. The error wraps
+// that of the first failed device, so that it sets the exit code.
+func clientEach() error {
+	paths, err := expandBlobPaths(blobPaths.paths)
+	if err != nil {
+		return err
+	}
+	if tpmPath != "" && len(paths) > 1 {
+		return fmt.Errorf("%w: multiple -blob values cannot be used with -tpm", errUsage)
+	}
+	if splitSecrets() && len(paths) > 1 {
+		return fmt.Errorf("%w: -key-file and -hmac-file cannot be used with multiple -blob values", errUsage)
+	}
+	if len(paths) == 1 {
+		blobPath = paths[0]
+		err := client()
+		setStatusError(err)
+		return err
+	}
+
+	var failed []string
+	var firstErr error
+	for _, path := range paths {
+		blobPath = path
+		if err := client(); err != nil {
+			setStatusError(err)
+			slog.Error("Device failed", "blob", path, "error", err)
+			failed = append(failed, path)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		slog.Info("Device succeeded", "blob", path)
+	}
+	slog.Info("Devices processed", "total", len(paths), "succeeded", len(paths)-len(failed), "failed", len(failed))
+	if len(failed) > 0 {
+		return fmt.Errorf("failed devices: %s: %w", strings.Join(failed, ", "), firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state, such as "READY=1", to the service manager when run
+// as a systemd Type=notify unit. It does nothing if NOTIFY_SOCKET is unset.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// Abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Debug("Notifying service manager failed", "error", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Debug("Notifying service manager failed", "error", err)
+	}
+}
+
+// sdStatus sends a human readable status of the current phase to the service
+// manager and -status-addr.
+func sdStatus(status string) {
+	setStatusPhase(status)
+	sdNotify("STATUS=" + status)
+}
+
+// sdWatchdogInterval returns the interval at which the service manager expects
+// WATCHDOG=1 pings, which is half its timeout, or zero if the watchdog is not
+// enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 || os.Getenv("NOTIFY_SOCKET") == "" {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"hash"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Supported is whether -pkcs11-module may be given.
+const pkcs11Supported = true
+
+// p11 is the open PKCS#11 token when -pkcs11-module is set.
+var p11 *crypto11.Context
+
+func pkcs11Open() error {
+	pin, err := pkcs11UserPin()
+	if err != nil {
+		return err
+	}
+	p11, err = crypto11.Configure(&crypto11.Config{
+		Path:       pkcs11Module,
+		SlotNumber: &pkcs11Slot,
+		Pin:        pin,
+	})
+	if err != nil {
+		return fmt.Errorf("error opening PKCS#11 token: %w", err)
+	}
+	return nil
+}
+
+func pkcs11Close() error { return p11.Close() }
+
+// pkcs11Cred returns the HMACs and device key held by the PKCS#11 token. When
+// generate is set, any existing objects are replaced by a new device key of
+// the -di-key type and a new HMAC secret.
+func pkcs11Cred(generate bool) (hash.Hash, hash.Hash, crypto.Signer, error) {
+	if generate {
+		if err := pkcs11Generate(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	key, err := p11.FindKeyPair(nil, []byte(pkcs11KeyLabel))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error finding PKCS#11 device key: %w", err)
+	} else if key == nil {
+		return nil, nil, nil, fmt.Errorf("PKCS#11 device key %q not found", pkcs11KeyLabel)
+	}
+	secret, err := p11.FindKey(nil, []byte(pkcs11HmacLabel))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error finding PKCS#11 HMAC secret: %w", err)
+	} else if secret == nil {
+		return nil, nil, nil, fmt.Errorf("PKCS#11 HMAC secret %q not found", pkcs11HmacLabel)
+	}
+
+	h256, err := secret.NewHMAC(pkcs11.CKM_SHA256_HMAC, 0)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error creating PKCS#11 HMAC-SHA256: %w", err)
+	}
+	h384, err := secret.NewHMAC(pkcs11.CKM_SHA384_HMAC, 0)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error creating PKCS#11 HMAC-SHA384: %w", err)
+	}
+	return h256, h384, key, nil
+}
+
+func pkcs11Generate() error {
+	// Remove the objects of a previous DI
+	if key, err := p11.FindKeyPair(nil, []byte(pkcs11KeyLabel)); err == nil && key != nil {
+		if err := key.Delete(); err != nil {
+			return fmt.Errorf("error deleting PKCS#11 device key: %w", err)
+		}
+	}
+	if secret, err := p11.FindKey(nil, []byte(pkcs11HmacLabel)); err == nil && secret != nil {
+		if err := secret.Delete(); err != nil {
+			return fmt.Errorf("error deleting PKCS#11 HMAC secret: %w", err)
+		}
+	}
+
+	keyID := make([]byte, 16)
+	if _, err := rand.Read(keyID); err != nil {
+		return err
+	}
+	label := []byte(pkcs11KeyLabel)
+	var err error
+	switch diKey {
+	case "ec256":
+		_, err = p11.GenerateECDSAKeyPairWithLabel(keyID, label, elliptic.P256())
+	case "ec384":
+		_, err = p11.GenerateECDSAKeyPairWithLabel(keyID, label, elliptic.P384())
+	case "rsa2048":
+		_, err = p11.GenerateRSAKeyPairWithLabel(keyID, label, 2048)
+	case "rsa3072":
+		_, err = p11.GenerateRSAKeyPairWithLabel(keyID, label, 3072)
+	default:
+		err = fmt.Errorf("unsupported key type")
+	}
+	if err != nil {
+		return fmt.Errorf("error generating PKCS#11 device key: %w", err)
+	}
+
+	secretID := make([]byte, 16)
+	if _, err := rand.Read(secretID); err != nil {
+		return err
+	}
+	if _, err := p11.GenerateSecretKeyWithLabel(secretID, []byte(pkcs11HmacLabel), 256, crypto11.CipherGeneric); err != nil {
+		return fmt.Errorf("error generating PKCS#11 HMAC secret: %w", err)
+	}
+	return nil
+}
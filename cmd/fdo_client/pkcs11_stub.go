@@ -0,0 +1,22 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build !pkcs11
+
+package main
+
+import (
+	"crypto"
+	"hash"
+)
+
+// pkcs11Supported is whether -pkcs11-module may be given.
+const pkcs11Supported = false
+
+func pkcs11Open() error { return errPkcs11Unsupported }
+
+func pkcs11Close() error { return nil }
+
+func pkcs11Cred(bool) (hash.Hash, hash.Hash, crypto.Signer, error) {
+	return nil, nil, nil, errPkcs11Unsupported
+}
@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo"
+)
+
+// Labels of the objects holding the device key and HMAC secret in the
+// PKCS#11 token.
+const (
+	pkcs11KeyLabel  = "fdo-device-key"
+	pkcs11HmacLabel = "fdo-device-hmac"
+)
+
+// pkcs11PinEnv is the environment variable the user PIN of the PKCS#11 token
+// is read from when neither -pkcs11-pin nor -pkcs11-pin-file is given.
+const pkcs11PinEnv = "FDO_PKCS11_PIN"
+
+// errPkcs11Unsupported is returned for -pkcs11-module by a client built
+// without PKCS#11 support, which requires cgo.
+var errPkcs11Unsupported = errors.New("-pkcs11-module requires a client built with -tags pkcs11 (and cgo)")
+
+// fdoPkcs11DeviceCredential is stored in the blob file when the device key
+// and HMAC secret are held by a PKCS#11 token.
+type fdoPkcs11DeviceCredential struct {
+	DC    fdo.DeviceCredential
+	State FdoDeviceState
+}
+
+// pkcs11UserPin returns the PIN of -pkcs11-pin, the first line of
+// -pkcs11-pin-file or the FDO_PKCS11_PIN environment variable.
+func pkcs11UserPin() (string, error) {
+	switch {
+	case pkcs11Pin != "":
+		return pkcs11Pin, nil
+	case pkcs11PinFile != "":
+		data, err := os.ReadFile(filepath.Clean(pkcs11PinFile))
+		if err != nil {
+			return "", fmt.Errorf("error reading PKCS#11 PIN file %q: %w", pkcs11PinFile, err)
+		}
+		pin, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSuffix(pin, "\r"), nil
+	}
+	return os.Getenv(pkcs11PinEnv), nil
+}
@@ -0,0 +1,43 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPkcs11UserPin(t *testing.T) {
+	defer func(pin, file string) { pkcs11Pin, pkcs11PinFile = pin, file }(pkcs11Pin, pkcs11PinFile)
+	t.Setenv(pkcs11PinEnv, "5678")
+
+	pinFile := filepath.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(pinFile, []byte("1234\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name, pin, file, want string
+	}{
+		{name: "flag", pin: "0000", want: "0000"},
+		{name: "file", file: pinFile, want: "1234"},
+		{name: "environment", want: "5678"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pkcs11Pin, pkcs11PinFile = test.pin, test.file
+			pin, err := pkcs11UserPin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pin != test.want {
+				t.Errorf("expected PIN %q, got %q", test.want, pin)
+			}
+		})
+	}
+
+	pkcs11Pin, pkcs11PinFile = "", filepath.Join(t.TempDir(), "missing")
+	if _, err := pkcs11UserPin(); err == nil {
+		t.Error("expected a missing PIN file to fail")
+	}
+}
@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo/blob"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// printCred prints a device credential read for -print. Unless -show-secrets
+// is set, the HMAC secret and private key of blob credentials are replaced by
+// their sizes and types. TPM credentials only hold key handles and are
+// printed as is.
+func printCred(v any) {
+	if dc, ok := v.(*fdoDeviceCredential); ok && !showSecrets {
+		fmt.Printf("&{DC:%s State:%d}\n", redactBlobCred(dc.DC), dc.State)
+	} else {
+		fmt.Printf("%+v\n", v)
+	}
+	printFingerprints(v)
+}
+
+// printFingerprints prints the SHA-256 fingerprint of the device public key
+// and the manufacturer public key hash, for matching a device against the
+// owner inventory.
+func printFingerprints(v any) {
+	var pub crypto.PublicKey
+	var mfgKeyHash protocol.Hash
+	switch dc := v.(type) {
+	case *fdoDeviceCredential:
+		if dc.DC.PrivateKey.IsValid() {
+			pub = dc.DC.PrivateKey.Public()
+		}
+		mfgKeyHash = dc.DC.PublicKeyHash
+	case *fdoTpmDeviceCredential:
+		// The device key is a TPM primary key, so it is recreated from its
+		// template rather than read from the credential
+		if _, _, key, cleanup, err := tpmCred(); err != nil {
+			fmt.Printf("Device public key (SHA-256): unavailable (%v)\n", err)
+		} else {
+			pub = key.Public()
+			defer func() { _ = cleanup() }()
+		}
+		mfgKeyHash = dc.DC.PublicKeyHash
+	case *fdoPkcs11DeviceCredential:
+		if _, _, key, err := pkcs11Cred(false); err != nil {
+			fmt.Printf("Device public key (SHA-256): unavailable (%v)\n", err)
+		} else {
+			pub = key.Public()
+		}
+		mfgKeyHash = dc.DC.PublicKeyHash
+	default:
+		return
+	}
+
+	if pub != nil {
+		fingerprint, err := keyFingerprint(pub)
+		if err != nil {
+			fmt.Printf("Device public key (SHA-256): unavailable (%v)\n", err)
+		} else {
+			fmt.Printf("Device public key (SHA-256): %s\n", fingerprint)
+		}
+	}
+	fmt.Printf("Manufacturer key hash (%s): %x\n", mfgKeyHash.Algorithm, mfgKeyHash.Value)
+}
+
+// keyFingerprint returns the hex encoded SHA-256 digest of the PKIX (DER)
+// encoding of a public key.
+func keyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// redactBlobCred formats a blob credential like blob.DeviceCredential.String,
+// without key material.
+func redactBlobCred(dc blob.DeviceCredential) string {
+	key := "<none>"
+	if dc.PrivateKey.IsValid() {
+		key = fmt.Sprintf("%T <redacted>", dc.PrivateKey.Signer)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `blobcred[
+  Active        %t
+  Version       %d
+  DeviceInfo   %q
+  GUID          %x
+  PublicKeyHash
+    Algorithm   %s
+    Value       %x
+  HmacSecret    <redacted, %d bytes>
+  PrivateKey    %s
+  RvInfo
+`, dc.Active, dc.Version, dc.DeviceInfo, dc.GUID, dc.PublicKeyHash.Algorithm, dc.PublicKeyHash.Value, len(dc.HmacSecret), key)
+	for _, directive := range dc.RvInfo {
+		b.WriteString("    >\n")
+		for _, instruction := range directive {
+			fmt.Fprintf(&b, "      %d = %x\n", instruction.Variable, instruction.Value)
+		}
+	}
+	b.WriteString("]")
+	return b.String()
+}
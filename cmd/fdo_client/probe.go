@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo-client/internal/tls"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+const probeTimeout = 5 * time.Second
+
+// filterOwners returns the base URLs which appear to be served by an FDO owner.
+func filterOwners(ctx context.Context, baseURLs []string) []string {
+	var owners []string
+	for _, baseURL := range baseURLs {
+		if probeOwner(ctx, baseURL) {
+			owners = append(owners, baseURL)
+		}
+	}
+	return owners
+}
+
+// probeOwner issues a GET for the TO2.HelloDevice endpoint. FDO servers only
+// accept POST, so respond with an error status such as 405, while reverse
+// proxies and load balancers without a matching backend respond with 404 or
+// a gateway error.
+func probeOwner(ctx context.Context, baseURL string) bool {
+	uri, err := url.JoinPath(baseURL, "fdo/101/msg", strconv.Itoa(int(protocol.TO2HelloDeviceMsgType)))
+	if err != nil {
+		slog.Warn("Owner probe failed, skipping URL", "base URL", baseURL, "error", err)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		slog.Warn("Owner probe failed, skipping URL", "base URL", baseURL, "error", err)
+		return false
+	}
+	resp, err := tls.HTTPClientWithHeaders(ownerTLSConfig(), insecureTLS, http.Header(ownerHeaders)).Do(req)
+	if err != nil {
+		slog.Warn("Owner probe failed, skipping URL", "base URL", baseURL, "error", err)
+		return false
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		slog.Warn("Owner probe returned a non-FDO response, skipping URL", "base URL", baseURL, "status", resp.Status)
+		return false
+	}
+	slog.Debug("Owner probe succeeded", "base URL", baseURL, "status", resp.Status)
+	return true
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// progress logs the bytes transferred by an FSIM and the throughput since the
+// transfer started at most once per interval.
+type progress struct {
+	module   string
+	interval time.Duration
+
+	mu    sync.Mutex
+	start time.Time
+	last  time.Time
+	n     int64
+}
+
+func newProgress(module string, interval time.Duration) *progress {
+	if interval <= 0 {
+		return nil
+	}
+	return &progress{module: module, interval: interval}
+}
+
+func (p *progress) add(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start, p.last = now, now
+	}
+	p.n += int64(n)
+	if now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last = now
+	elapsed := now.Sub(p.start).Seconds()
+	slog.Info("Transfer progress", "module", p.module, "bytes", p.n,
+		"throughput (B/s)", int64(float64(p.n)/elapsed))
+}
+
+type progressReader struct {
+	io.Reader
+	p *progress
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.p.add(n)
+	return n, err
+}
+
+// progressModule reports the file data received by an FSIM such as
+// fdo.download.
+type progressModule struct {
+	serviceinfo.DeviceModule
+	p *progress
+}
+
+func (m progressModule) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	if messageName == "data" {
+		messageBody = progressReader{Reader: messageBody, p: m.p}
+	}
+	return m.DeviceModule.Receive(ctx, messageName, messageBody, respond, yield)
+}
+
+// progressFS reports the file data read by an FSIM such as fdo.upload.
+type progressFS struct {
+	fs.FS
+	p *progress
+}
+
+func (p progressFS) Open(name string) (fs.File, error) {
+	f, err := p.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return progressFile{File: f, p: p.p}, nil
+}
+
+type progressFile struct {
+	fs.File
+	p *progress
+}
+
+func (f progressFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.p.add(n)
+	return n, err
+}
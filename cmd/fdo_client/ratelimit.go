@@ -0,0 +1,189 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// fsimRate limits the file data of fdo.download, fdo.upload and fdo.wget
+// together to -rate-limit bytes per second. It is nil if unlimited.
+var fsimRate *rateLimiter
+
+// rateLimiter is a token bucket which refills at rate bytes per second and
+// holds at most one second of tokens.
+type rateLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSec)}
+}
+
+// chunk returns the size to limit a read of len(b) bytes to, so that no
+// single read is delayed for much more than a second.
+func (l *rateLimiter) chunk(b []byte) []byte {
+	if n := max(int(l.rate), 1); len(b) > n {
+		return b[:n]
+	}
+	return b
+}
+
+// wait takes n tokens and blocks until the bucket is no longer in debt or ctx
+// is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = l.rate
+	} else {
+		l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type rateReader struct {
+	io.Reader
+	ctx context.Context
+	l   *rateLimiter
+}
+
+func (r rateReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(r.l.chunk(b))
+	if waitErr := r.l.wait(r.ctx, n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// rateModule limits the file data received by an FSIM such as fdo.download.
+type rateModule struct {
+	serviceinfo.DeviceModule
+	l *rateLimiter
+}
+
+func (m rateModule) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	if messageName == "data" {
+		messageBody = rateReader{Reader: messageBody, ctx: ctx, l: m.l}
+	}
+	return m.DeviceModule.Receive(ctx, messageName, messageBody, respond, yield)
+}
+
+// receiveCtx holds the context of the Receive in progress of an FSIM, such as
+// fdo.upload, which reads its files without one.
+type receiveCtx struct {
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+func (c *receiveCtx) set(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctx = ctx
+}
+
+func (c *receiveCtx) get() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// receiveCtxModule records the context of each Receive of an FSIM in ctx.
+type receiveCtxModule struct {
+	serviceinfo.DeviceModule
+	ctx *receiveCtx
+}
+
+func (m receiveCtxModule) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	m.ctx.set(ctx)
+	defer m.ctx.set(nil)
+	return m.DeviceModule.Receive(ctx, messageName, messageBody, respond, yield)
+}
+
+// rateFS limits the file data read by an FSIM such as fdo.upload. Waits end
+// when the context of the FSIM's Receive in progress is done.
+type rateFS struct {
+	fs.FS
+	l   *rateLimiter
+	ctx *receiveCtx
+}
+
+func (r rateFS) Open(name string) (fs.File, error) {
+	f, err := r.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return rateFile{File: f, l: r.l, ctx: r.ctx}, nil
+}
+
+type rateFile struct {
+	fs.File
+	l   *rateLimiter
+	ctx *receiveCtx
+}
+
+func (f rateFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(f.l.chunk(b))
+	if waitErr := f.l.wait(f.ctx.get(), n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// rateRoundTripper limits the response bodies of fdo.wget downloads.
+type rateRoundTripper struct {
+	base http.RoundTripper
+	l    *rateLimiter
+}
+
+func (rt rateRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = rateBody{rateReader: rateReader{Reader: resp.Body, ctx: req.Context(), l: rt.l}, closer: resp.Body}
+	return resp, nil
+}
+
+type rateBody struct {
+	rateReader
+	closer io.Closer
+}
+
+func (b rateBody) Close() error { return b.closer.Close() }
@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// readModule reads a file of its FS in Receive, as fdo.upload does.
+type readModule struct {
+	serviceinfo.DeviceModule
+	fsys rateFS
+	err  error
+}
+
+func (m *readModule) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	f, err := m.fsys.Open("file")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	_, m.err = io.ReadAll(f)
+	return nil
+}
+
+func TestRateFileUsesReceiveContext(t *testing.T) {
+	ctx := new(receiveCtx)
+	read := &readModule{fsys: rateFS{
+		FS:  fstest.MapFS{"file": {Data: []byte("0123456789")}},
+		l:   newRateLimiter(1),
+		ctx: ctx,
+	}}
+	module := receiveCtxModule{DeviceModule: read, ctx: ctx}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := module.Receive(canceled, "name", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(read.err, context.Canceled) {
+		t.Errorf("expected the canceled Receive context to stop the read, got %v", read.err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read waited %s after the context was canceled", elapsed)
+	}
+	if ctx.get() != context.Background() {
+		t.Error("Receive context kept after Receive returned")
+	}
+}
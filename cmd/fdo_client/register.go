@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// builtinModules are the names of the service info modules provided by the
+// client, which may not be registered.
+var builtinModules = []string{"devmod", "fido_alliance", "fdo.command", "fdo.download", "fdo.upload", "fdo.wget"}
+
+// customModules are the constructors of modules added by RegisterDeviceModule.
+var customModules = make(map[string]func() serviceinfo.DeviceModule)
+
+// RegisterDeviceModule adds a service info module to TO2, so that vendor
+// specific modules can be built into the client from a separate source file in
+// this package, usually with a build tag, by calling it from an init function.
+// As the client is package main, RegisterDeviceModule cannot be imported: the
+// source file must be added to cmd/fdo_client and the client rebuilt.
+//
+// A new module is created by factory for each TO2 attempt. RegisterDeviceModule
+// panics if name is empty or already used by a built-in or registered module.
+func RegisterDeviceModule(name string, factory func() serviceinfo.DeviceModule) {
+	if name == "" || factory == nil {
+		panic("fdo_client: RegisterDeviceModule requires a name and factory")
+	}
+	if slices.Contains(builtinModules, name) {
+		panic(fmt.Sprintf("fdo_client: module %q is built in and cannot be registered", name))
+	}
+	if _, dup := customModules[name]; dup {
+		panic(fmt.Sprintf("fdo_client: module %q is already registered", name))
+	}
+	customModules[name] = factory
+}
+
+// knownModules returns the sorted names of the built-in and registered modules.
+func knownModules() []string {
+	names := slices.Clone(builtinModules)
+	for name := range customModules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// modulesVar is the flag value of -skip-fsim.
+type modulesVar []string
+
+func (m *modulesVar) String() string { return strings.Join(*m, ",") }
+
+func (m *modulesVar) Set(names string) error {
+	for _, name := range strings.Split(names, ",") {
+		*m = append(*m, strings.TrimSpace(name))
+	}
+	return nil
+}
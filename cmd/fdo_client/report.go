@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// reportEvent is a single entry of the -report timeline.
+type reportEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	URL    string    `json:"url,omitempty"`
+	Module string    `json:"module,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// onboardReport collects the events of an onboarding run for -report.
+var onboardReport struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []reportEvent
+}
+
+// recordEvent adds an event to the timeline. A non-nil err is recorded
+// verbatim.
+func recordEvent(event reportEvent, err error) {
+	event.Time = time.Now()
+	if err != nil {
+		event.Error = err.Error()
+	}
+	setStatusError(err)
+	onboardReport.mu.Lock()
+	defer onboardReport.mu.Unlock()
+	if onboardReport.start.IsZero() {
+		onboardReport.start = event.Time
+	}
+	onboardReport.events = append(onboardReport.events, event)
+}
+
+// writeReport writes the timeline and outcome of the onboarding run to path
+// as JSON.
+func writeReport(path string, success bool, state FdoDeviceState) error {
+	onboardReport.mu.Lock()
+	end := time.Now()
+	start := onboardReport.start
+	if start.IsZero() {
+		start = end
+	}
+	data, err := json.MarshalIndent(struct {
+		Start    time.Time     `json:"start"`
+		End      time.Time     `json:"end"`
+		Duration string        `json:"duration"`
+		Success  bool          `json:"success"`
+		State    int           `json:"state"`
+		Events   []reportEvent `json:"events"`
+	}{
+		Start:    start,
+		End:      end,
+		Duration: end.Sub(start).String(),
+		Success:  success,
+		State:    int(state),
+		Events:   onboardReport.events,
+	}, "", "  ")
+	onboardReport.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding report: %w", err)
+	}
+
+	return writeFileAtomic(path, 0o600, func(w io.Writer) error {
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("error writing report: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,24 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/cbor"
+)
+
+// saveResaleCred atomically writes the device credential received from the
+// new owner during resale to path. The credential does not contain the HMAC
+// secret or private key, which are unchanged by resale.
+func saveResaleCred(path string, dc fdo.DeviceCredential) error {
+	return writeFileAtomic(path, 0o600, func(w io.Writer) error {
+		if err := cbor.NewEncoder(w).Encode(dc); err != nil {
+			return fmt.Errorf("error encoding resale credential: %w", err)
+		}
+		return nil
+	})
+}
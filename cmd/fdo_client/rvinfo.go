@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+var rvProtocols = map[string]uint8{
+	"rest":     protocol.RVProtRest,
+	"http":     protocol.RVProtHTTP,
+	"https":    protocol.RVProtHTTPS,
+	"tcp":      protocol.RVProtTCP,
+	"tls":      protocol.RVProtTLS,
+	"coap+tcp": protocol.RVProtCoapTCP,
+	"coap":     protocol.RVProtCoapUDP,
+}
+
+// readRvInfoFile reads RV info from a file containing either the CBOR encoded
+// RendezvousInfo or one directive per line in the form
+//
+//	protocol=https dns=rv.example.com ip=192.0.2.1 port=8443 delay=30
+//
+// where each instruction is optional and "bypass" may be added to skip TO1.
+// Delays are in seconds or a duration such as 2m or 1h30m.
+// Empty lines and lines starting with # are ignored. The RV info must contain
+// at least one directive with an address for the device.
+func readRvInfoFile(path string) ([][]protocol.RvInstruction, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading RV info %q: %w", path, err)
+	}
+
+	var rvInfo [][]protocol.RvInstruction
+	if err := cbor.Unmarshal(data, &rvInfo); err != nil {
+		if rvInfo, err = parseRvInfo(data); err != nil {
+			return nil, fmt.Errorf("error parsing RV info %q: %w", path, err)
+		}
+	}
+
+	if !rvInfoUsable(rvInfo) {
+		return nil, fmt.Errorf("RV info %q contains no directive with an address for the device", path)
+	}
+	return rvInfo, nil
+}
+
+// rvInfoUsable reports whether the RV info contains at least one directive
+// with an address for the device. Directives with only a delay may be
+// included, but cannot onboard the device on their own.
+func rvInfoUsable(rvInfo [][]protocol.RvInstruction) bool {
+	for _, directive := range protocol.ParseDeviceRvInfo(rvInfo) {
+		if len(directive.URLs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRvInfo(data []byte) ([][]protocol.RvInstruction, error) {
+	var rvInfo [][]protocol.RvInstruction
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var directive []protocol.RvInstruction
+		for _, field := range strings.Fields(line) {
+			instruction, err := parseRvInstruction(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			directive = append(directive, instruction)
+		}
+		rvInfo = append(rvInfo, directive)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rvInfo, nil
+}
+
+func parseRvInstruction(field string) (protocol.RvInstruction, error) {
+	key, value, _ := strings.Cut(field, "=")
+
+	var v protocol.RvVar
+	var val any
+	switch key {
+	case "bypass":
+		return protocol.RvInstruction{Variable: protocol.RVBypass}, nil
+	case "dns":
+		if !isValidHostname(value) {
+			return protocol.RvInstruction{}, fmt.Errorf("invalid dns %q", value)
+		}
+		v, val = protocol.RVDns, value
+	case "ip":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return protocol.RvInstruction{}, fmt.Errorf("invalid ip %q", value)
+		}
+		v, val = protocol.RVIPAddress, ip
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || port == 0 {
+			return protocol.RvInstruction{}, fmt.Errorf("invalid port %q", value)
+		}
+		v, val = protocol.RVDevPort, uint16(port)
+	case "protocol":
+		proto, ok := rvProtocols[value]
+		if !ok {
+			return protocol.RvInstruction{}, fmt.Errorf("invalid protocol %q", value)
+		}
+		v, val = protocol.RVProtocol, proto
+	case "delay":
+		secs, err := parseRvDelay(value)
+		if err != nil {
+			return protocol.RvInstruction{}, err
+		}
+		v, val = protocol.RVDelaysec, secs
+	default:
+		return protocol.RvInstruction{}, fmt.Errorf("unknown RV instruction %q", key)
+	}
+
+	enc, err := cbor.Marshal(val)
+	if err != nil {
+		return protocol.RvInstruction{}, err
+	}
+	return protocol.RvInstruction{Variable: v, Value: enc}, nil
+}
+
+// parseRvDelay parses a delay given in seconds or as a duration, such as 2m or
+// 1h30m, into the whole seconds of RVDelaysec.
+func parseRvDelay(value string) (uint32, error) {
+	if strings.HasPrefix(value, "-") {
+		return 0, fmt.Errorf("invalid delay %q: must not be negative", value)
+	}
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(secs), nil
+	}
+	d, err := time.ParseDuration(value)
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("invalid delay %q: must be seconds or a duration such as 2m or 1h30m", value)
+	case d%time.Second != 0:
+		return 0, fmt.Errorf("invalid delay %q: must be whole seconds", value)
+	case d/time.Second > math.MaxUint32:
+		return 0, fmt.Errorf("invalid delay %q: must be at most %d seconds", value, uint32(math.MaxUint32))
+	}
+	return uint32(d / time.Second), nil
+}
@@ -0,0 +1,38 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadRvInfoFileRequiresAddress(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		rvInfo string
+		usable bool
+	}{
+		{name: "address", rvInfo: "protocol=http ip=127.0.0.1 port=8041", usable: true},
+		{name: "delay and address", rvInfo: "delay=30\nprotocol=http dns=rv.example.com port=8041", usable: true},
+		{name: "delay only", rvInfo: "delay=30\ndelay=2m"},
+		{name: "comments only", rvInfo: "# no directives"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rvinfo.txt")
+			if err := os.WriteFile(path, []byte(test.rvInfo), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readRvInfoFile(path)
+			if test.usable && err != nil {
+				t.Fatal(err)
+			}
+			if !test.usable && (err == nil || !strings.Contains(err.Error(), "no directive with an address")) {
+				t.Fatalf("expected RV info without an address to be rejected, got %v", err)
+			}
+		})
+	}
+}
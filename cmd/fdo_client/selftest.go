@@ -0,0 +1,209 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fido-device-onboard/go-fdo-client/internal/tpm_utils"
+	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/tpm"
+	"github.com/google/go-tpm/tpm2"
+)
+
+// selftestNVIndex is the scratch NV index written and removed by selftest,
+// next to the index of the device credential.
+const selftestNVIndex = FDO_CRED_NV_IDX + 1
+
+// errSelftestFailed is returned by selftest when any check failed.
+var errSelftestFailed = errors.New("self-test failed")
+
+// selfCheck is a check of selftest.
+type selfCheck struct {
+	name string
+	run  func() error
+}
+
+// selftestCommand runs "fdo_client selftest [flags]", which checks without
+// contacting any server that the device can run DI and onboarding: the blob
+// dir is writable, or the TPM generates each key type, computes HMACs and
+// writes and reads NV, and the cipher suites are available.
+func selftestCommand(args []string) error {
+	selfFlags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	selfFlags.StringVar(&blobPath, "blob", "cred.bin", "File `path` of the device credential blob, whose dir must be writable")
+	selfFlags.StringVar(&tpmPath, "tpm", "", "Check the TPM at `path` instead of the blob dir")
+	selfFlags.StringVar(&kexSuite, "kex", "ECDH384", "Name of the key exchange `suite` to check")
+	selfFlags.StringVar(&cipherSuite, "cipher", "A128GCM", "Name of the cipher `suite` to check")
+	selfFlags.Usage = func() {
+		fmt.Fprintln(selfFlags.Output(), "Usage: fdo_client selftest [-blob path | -tpm path] [-kex suite] [-cipher suite]")
+		selfFlags.PrintDefaults()
+	}
+	addLogFlags(selfFlags)
+	if err := selfFlags.Parse(args); err != nil || selfFlags.NArg() > 0 {
+		return errUsage
+	}
+	if err := setupLogging(); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+
+	checks := []selfCheck{
+		{"random number generator", func() error {
+			_, err := rand.Read(make([]byte, 32))
+			return err
+		}},
+		{"key exchange " + kexSuite + " with " + cipherSuite, func() error {
+			id, ok := kex.CipherSuiteByName(cipherSuite)
+			if !ok {
+				return fmt.Errorf("unknown cipher suite")
+			}
+			if !kex.Available(kex.Suite(kexSuite), id) {
+				return fmt.Errorf("not supported by this client")
+			}
+			return nil
+		}},
+	}
+	if tpmPath == "" {
+		checks = append(checks, selfCheck{"blob dir " + filepath.Dir(blobPath) + " writable", func() error {
+			return checkWritableDir(filepath.Dir(blobPath))
+		}})
+		return runSelfChecks(checks)
+	}
+
+	if err := tpm_utils.CheckTpmPath(tpmPath); err != nil {
+		return err
+	}
+	var err error
+	if tpmc, err = tpm_utils.TpmOpen(tpmPath); err != nil {
+		return err
+	}
+	defer func() { _ = tpmc.Close() }()
+	for _, key := range []struct {
+		name     string
+		generate func() (tpm.Key, error)
+	}{
+		{"ec256", func() (tpm.Key, error) { return tpm.GenerateECKey(tpmc, elliptic.P256()) }},
+		{"ec384", func() (tpm.Key, error) { return tpm.GenerateECKey(tpmc, elliptic.P384()) }},
+		{"rsa2048", func() (tpm.Key, error) { return tpm.GenerateRSAKey(tpmc, 2048) }},
+		{"rsa3072", func() (tpm.Key, error) { return tpm.GenerateRSAKey(tpmc, 3072) }},
+	} {
+		checks = append(checks, selfCheck{"TPM " + key.name + " key generation and signing", func() error {
+			k, err := key.generate()
+			if err != nil {
+				return err
+			}
+			defer func() { _ = k.Close() }()
+			return checkSigner(k)
+		}})
+	}
+	for _, h := range []crypto.Hash{crypto.SHA256, crypto.SHA384} {
+		checks = append(checks, selfCheck{"TPM HMAC-" + h.String(), func() error {
+			mac, err := tpm.NewHmac(tpmc, h)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = mac.Close() }()
+			_, _ = mac.Write([]byte("fdo selftest"))
+			first := mac.Sum(nil)
+			mac.Reset()
+			_, _ = mac.Write([]byte("fdo selftest"))
+			if err := mac.Err(); err != nil {
+				return err
+			}
+			if !bytes.Equal(first, mac.Sum(nil)) || len(first) != h.Size() {
+				return fmt.Errorf("HMAC is not repeatable")
+			}
+			return nil
+		}})
+	}
+	checks = append(checks, selfCheck{fmt.Sprintf("TPM NV write and read at index %#x", selftestNVIndex), checkTpmNV})
+	return runSelfChecks(checks)
+}
+
+// runSelfChecks runs every check, printing PASS or FAIL with the error for
+// each, and returns errSelftestFailed if any failed.
+func runSelfChecks(checks []selfCheck) error {
+	failed := 0
+	for _, check := range checks {
+		if err := check.run(); err != nil {
+			fmt.Printf("FAIL  %s: %v\n", check.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("PASS  %s\n", check.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d checks", errSelftestFailed, failed, len(checks))
+	}
+	return nil
+}
+
+// checkSigner signs a digest of the hash FDO uses with key and verifies the
+// signature with its public key.
+func checkSigner(key crypto.Signer) error {
+	size, err := deviceKeyHashSize(key.Public())
+	if err != nil {
+		return err
+	}
+	h := crypto.SHA256
+	if size == 384 {
+		h = crypto.SHA384
+	}
+	digest := h.New()
+	_, _ = digest.Write([]byte("fdo selftest"))
+	sum := digest.Sum(nil)
+	sig, err := key.Sign(rand.Reader, sum, h)
+	if err != nil {
+		return err
+	}
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, sum, sig) {
+			return fmt.Errorf("signature does not verify")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, h, sum, sig); err != nil {
+			return fmt.Errorf("signature does not verify: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkTpmNV writes random data to the scratch NV index, reads it back and
+// removes the index. An index already in use is not touched.
+func checkTpmNV() error {
+	nv := tpm2.TPMHandle(selftestNVIndex)
+	if tpm_utils.TpmNVGetSize(tpmc, nv) > 0 {
+		return fmt.Errorf("index is already in use")
+	}
+	data := make([]byte, 1024)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	if err := tpm_utils.TpmNVWrite(tpmc, data, nv, tpm2.TPMAlgSHA256); err != nil {
+		return err
+	}
+	defer func() {
+		if err := tpm_utils.TpmNVRemove(tpmc, nv); err != nil {
+			fmt.Fprintf(os.Stderr, "error removing self-test NV index %#x: %v\n", selftestNVIndex, err)
+		}
+	}()
+	read, err := tpm_utils.TpmNVRead(tpmc, nv)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, data) {
+		return fmt.Errorf("read back %d bytes which differ from the %d bytes written", len(read), len(data))
+	}
+	return nil
+}
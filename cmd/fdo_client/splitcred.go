@@ -0,0 +1,199 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/blob"
+	"github.com/fido-device-onboard/go-fdo/cbor"
+)
+
+// splitDeviceCredential is encoded like blob.DeviceCredential, but a secret
+// kept in -key-file or -hmac-file is stored as an empty byte string.
+type splitDeviceCredential struct {
+	Active bool
+	fdo.DeviceCredential
+	HmacSecret []byte
+	PrivateKey []byte
+}
+
+type fdoSplitDeviceCredential struct {
+	DC    splitDeviceCredential
+	State FdoDeviceState
+}
+
+// splitSecrets reports whether -key-file or -hmac-file keeps a secret of the
+// blob credential in a file of its own.
+func splitSecrets() bool { return keyFile != "" || hmacFile != "" }
+
+// unmarshalSplitCred decodes a blob credential and fills in the secrets kept
+// in -key-file and -hmac-file. A secret may be in the blob or its file, not
+// both.
+func unmarshalSplitCred(data []byte, dc *fdoDeviceCredential) error {
+	var split fdoSplitDeviceCredential
+	if err := cbor.Unmarshal(data, &split); err != nil {
+		return err
+	}
+	dc.DC = blob.DeviceCredential{
+		Active:           split.DC.Active,
+		DeviceCredential: split.DC.DeviceCredential,
+		HmacSecret:       split.DC.HmacSecret,
+	}
+	dc.State = split.State
+
+	switch {
+	case hmacFile != "" && len(split.DC.HmacSecret) > 0:
+		return fmt.Errorf("HMAC secret is both in the blob and -hmac-file %q", hmacFile)
+	case hmacFile != "":
+		secret, err := readHmacFile(hmacFile)
+		if err != nil {
+			return err
+		}
+		dc.DC.HmacSecret = secret
+	case len(split.DC.HmacSecret) == 0:
+		return fmt.Errorf("blob has no HMAC secret, give its file with -hmac-file")
+	}
+
+	switch {
+	case keyFile != "" && len(split.DC.PrivateKey) > 0:
+		return fmt.Errorf("private key is both in the blob and -key-file %q", keyFile)
+	case keyFile != "":
+		key, err := readKeyFile(keyFile)
+		if err != nil {
+			return err
+		}
+		dc.DC.PrivateKey = blob.Pkcs8Key{Signer: key}
+	case len(split.DC.PrivateKey) == 0:
+		return fmt.Errorf("blob has no private key, give its file with -key-file")
+	default:
+		key, err := x509.ParsePKCS8PrivateKey(split.DC.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("error parsing private key: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("error parsing private key: unsupported key %T", key)
+		}
+		dc.DC.PrivateKey = blob.Pkcs8Key{Signer: signer}
+	}
+	return nil
+}
+
+// splitCred writes the secrets of dc which are kept in -key-file and
+// -hmac-file to their files and returns dc without them, for saving as the
+// blob.
+func splitCred(dc fdoDeviceCredential) (fdoSplitDeviceCredential, error) {
+	split := fdoSplitDeviceCredential{
+		DC: splitDeviceCredential{
+			Active:           dc.DC.Active,
+			DeviceCredential: dc.DC.DeviceCredential,
+			HmacSecret:       dc.DC.HmacSecret,
+		},
+		State: dc.State,
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(dc.DC.PrivateKey.Signer)
+	if err != nil {
+		return fdoSplitDeviceCredential{}, fmt.Errorf("error marshaling private key: %w", err)
+	}
+	split.DC.PrivateKey = der
+
+	if keyFile != "" {
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := writeSecretFile(keyFile, data); err != nil {
+			return fdoSplitDeviceCredential{}, err
+		}
+		split.DC.PrivateKey = []byte{}
+	}
+	if hmacFile != "" {
+		if err := writeSecretFile(hmacFile, dc.DC.HmacSecret); err != nil {
+			return fdoSplitDeviceCredential{}, err
+		}
+		split.DC.HmacSecret = []byte{}
+	}
+	return split, nil
+}
+
+// readKeyFile reads a device private key from a PEM "PRIVATE KEY" (PKCS#8),
+// "EC PRIVATE KEY" or "RSA PRIVATE KEY" block, or from PKCS#8 DER.
+func readKeyFile(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading -key-file: %w", err)
+	}
+	var key any
+	block, _ := pem.Decode(data)
+	switch {
+	case block == nil:
+		if key, err = x509.ParsePKCS8PrivateKey(data); err != nil {
+			return nil, fmt.Errorf("error parsing -key-file %q: not a PEM private key or PKCS#8 DER", path)
+		}
+	case block.Type == "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case block.Type == "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case block.Type == "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("error parsing -key-file %q: unexpected PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing -key-file %q: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || !(blob.Pkcs8Key{Signer: signer}).IsValid() {
+		return nil, fmt.Errorf("error parsing -key-file %q: unsupported key %T, must be EC P-256/P-384 or RSA 2048/3072", path, key)
+	}
+	return signer, nil
+}
+
+// readHmacFile reads an HMAC secret of 32 or 48 bytes, either raw or hex
+// encoded.
+func readHmacFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading -hmac-file: %w", err)
+	}
+	secret := data
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 64 || len(trimmed) == 96 {
+		if decoded, err := hex.DecodeString(string(trimmed)); err == nil {
+			secret = decoded
+		}
+	}
+	if len(secret) != 32 && len(secret) != 48 {
+		return nil, fmt.Errorf("error parsing -hmac-file %q: HMAC secret must be 32 or 48 bytes, raw or hex encoded", path)
+	}
+	return secret, nil
+}
+
+// writeSecretFile atomically replaces the file at path with data, readable by
+// its owner only. A file which already holds data is left untouched, so that
+// secret files may be read-only when the secret does not change.
+func writeSecretFile(path string, data []byte) error {
+	existing, err := os.ReadFile(filepath.Clean(path))
+	if err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error reading secret file %q: %w", path, err)
+	}
+
+	return writeFileAtomic(path, 0o600, func(w io.Writer) error {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("error writing temp file for secret: %w", err)
+		}
+		return nil
+	})
+}
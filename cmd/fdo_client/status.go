@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// currentStatus is the state of the client served by -status-addr. It is
+// updated by the onboarding goroutine and read by the status server.
+var currentStatus struct {
+	mu          sync.Mutex
+	Phase       string         `json:"phase"`
+	LastError   string         `json:"last_error,omitempty"`
+	Retries     int            `json:"retries"`
+	DeviceState FdoDeviceState `json:"device_state"`
+	Updated     time.Time      `json:"updated"`
+}
+
+// setStatusPhase records the phase of onboarding being run, with the device
+// state and number of retries at that point.
+func setStatusPhase(phase string) {
+	currentStatus.mu.Lock()
+	defer currentStatus.mu.Unlock()
+	currentStatus.Phase = phase
+	currentStatus.Retries = max(onboardMetrics.To1Attempts-1, 0) + max(onboardMetrics.To2Attempts-1, 0)
+	currentStatus.DeviceState = deviceStatus
+	currentStatus.Updated = time.Now()
+}
+
+// setStatusError records the last failure, if err is not nil.
+func setStatusError(err error) {
+	if err == nil {
+		return
+	}
+	currentStatus.mu.Lock()
+	defer currentStatus.mu.Unlock()
+	currentStatus.LastError = err.Error()
+	currentStatus.Updated = time.Now()
+}
+
+// withStatusServer returns run wrapped to serve /healthz and /status on
+// -status-addr while it runs. The server is shut down when run returns or the
+// client is interrupted.
+func withStatusServer(run func() error) func() error {
+	return func() error {
+		ln, err := net.Listen("tcp", statusAddr)
+		if err != nil {
+			return fmt.Errorf("error starting status server: %w", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = fmt.Fprintln(w, "ok")
+		})
+		mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+			currentStatus.mu.Lock()
+			data, err := json.Marshal(&currentStatus)
+			currentStatus.mu.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(append(data, '\n'))
+		})
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Status server failed", "error", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = srv.Shutdown(shutdownCtx)
+		}()
+		slog.Debug("Status server listening", "addr", ln.Addr().String())
+
+		err = run()
+		stop()
+		<-done
+		return err
+	}
+}
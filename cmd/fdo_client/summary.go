@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// transferredFile is a file received or sent by a service info module.
+type transferredFile struct {
+	Module string `json:"module"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+}
+
+// wgetFiles holds the final paths of files fetched by fdo.wget and
+// uploadedFiles the files read by fdo.upload, with the bytes sent.
+var (
+	wgetFiles     []string
+	uploadedFiles []*transferredFile
+)
+
+// transferredFiles returns the files moved during TO2, downloads first.
+func transferredFiles() []transferredFile {
+	var files []transferredFile
+	for _, download := range []struct {
+		module string
+		paths  []string
+	}{
+		{"fdo.download", downloadedFiles()},
+		{"fdo.wget", wgetFiles},
+	} {
+		for _, path := range download.paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			files = append(files, transferredFile{Module: download.module, Path: path, Size: info.Size()})
+		}
+	}
+	for _, upload := range uploadedFiles {
+		files = append(files, *upload)
+	}
+	return files
+}
+
+// printTransferSummary prints a table of the files moved during TO2, or a JSON
+// array with -log-format json. Nothing is printed if no file was moved.
+func printTransferSummary() {
+	files := transferredFiles()
+	if len(files) == 0 {
+		return
+	}
+	if logFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		if err := enc.Encode(struct {
+			Files []transferredFile `json:"transferred_files"`
+		}{files}); err != nil {
+			fmt.Fprintf(os.Stderr, "error printing transferred files: %v\n", err)
+		}
+		return
+	}
+	fmt.Println("Transferred files:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  MODULE\tBYTES\tPATH")
+	for _, file := range files {
+		fmt.Fprintf(w, "  %s\t%d\t%s\n", file.Module, file.Size, file.Path)
+	}
+	_ = w.Flush()
+}
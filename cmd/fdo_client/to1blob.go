@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/cbor/cdn"
+	"github.com/fido-device-onboard/go-fdo/cose"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// saveTo1Blob encodes the signed TO1 blob to CBOR and writes it to path.
+func saveTo1Blob(path string, to1d *cose.Sign1[protocol.To1d, []byte]) error {
+	return writeFileAtomic(path, 0o600, func(w io.Writer) error {
+		if err := cbor.NewEncoder(w).Encode(to1d); err != nil {
+			return fmt.Errorf("error encoding TO1 blob: %w", err)
+		}
+		return nil
+	})
+}
+
+// readTo1Blob reads a TO1 blob previously written by saveTo1Blob and checks
+// that it is well-formed. The signature is checked for a supported algorithm
+// here and cryptographically verified by TO2 against the owner key of the
+// ownership voucher, which is not known until TO2 has started.
+func readTo1Blob(path string) (*cose.Sign1[protocol.To1d, []byte], error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading TO1 blob %q: %w", path, err)
+	}
+
+	var to1d cose.Sign1[protocol.To1d, []byte]
+	if err := cbor.Unmarshal(data, &to1d); err != nil {
+		return nil, fmt.Errorf("error parsing TO1 blob %q: %w", path, err)
+	}
+
+	if len(to1d.Signature) == 0 {
+		return nil, fmt.Errorf("TO1 blob %q is not signed", path)
+	}
+	var alg cose.SignatureAlgorithm
+	if ok, err := to1d.Protected.Parse(cose.AlgLabel, &alg); err != nil {
+		return nil, fmt.Errorf("TO1 blob %q has an invalid signature algorithm: %w", path, err)
+	} else if !ok {
+		return nil, fmt.Errorf("TO1 blob %q is missing a signature algorithm", path)
+	}
+	if to1d.Payload == nil || len(to1d.Payload.Val.RV) == 0 {
+		return nil, fmt.Errorf("TO1 blob %q contains no TO2 addresses", path)
+	}
+
+	return &to1d, nil
+}
+
+// dumpTo1Blob prints the signed TO1 blob in CBOR diagnostic notation, followed
+// by its payload, which is otherwise only shown as a byte string.
+func dumpTo1Blob(to1d *cose.Sign1[protocol.To1d, []byte]) error {
+	for _, part := range []struct {
+		name string
+		v    any
+	}{
+		{"TO1 Blob", to1d},
+		{"TO1 Blob payload", to1d.Payload.Val},
+	} {
+		data, err := cbor.Marshal(part.v)
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %w", part.name, err)
+		}
+		diag, err := cdn.FromCBOR(data)
+		if err != nil {
+			return fmt.Errorf("error converting %s to diagnostic notation: %w", part.name, err)
+		}
+		fmt.Printf("%s (CBOR diagnostic notation): %s\n", part.name, diag)
+	}
+	return nil
+}
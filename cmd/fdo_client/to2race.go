@@ -0,0 +1,192 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/cose"
+	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// errLostRace is returned by a concurrent TO2 attempt which another attempt
+// overtook before the service info exchange.
+var errLostRace = errors.New("another TO2 attempt reached service info first")
+
+// The transport and TO2 run of each concurrent attempt, replaced by tests.
+var (
+	raceOwnerTransport = ownerTransport
+	raceAttempt        = transferOwnership2
+)
+
+// to2HmacSecret is the HMAC secret of the blob credential, from which each
+// concurrent TO2 attempt creates its own HMACs.
+var to2HmacSecret []byte
+
+// to2Race lets the first of the concurrent TO2 attempts to reach
+// TO2.DeviceServiceInfoReady continue and cancels the others. Until then an
+// attempt has only verified the owner and proven the device, so only the
+// winner runs service info modules and can complete TO2, and the canceled
+// attempts leave no state behind on the device or the owner.
+type to2Race struct {
+	mu       sync.Mutex
+	winner   int
+	cancels  []context.CancelFunc
+	done     []bool
+	canceled []bool
+}
+
+func newTo2Race(n int) *to2Race {
+	return &to2Race{
+		winner:   -1,
+		cancels:  make([]context.CancelFunc, n),
+		done:     make([]bool, n),
+		canceled: make([]bool, n),
+	}
+}
+
+// claim makes attempt i the winner, canceling the attempts which have not
+// finished, unless another attempt already won.
+func (r *to2Race) claim(i int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winner >= 0 {
+		return r.winner == i
+	}
+	r.winner = i
+	for j, cancel := range r.cancels {
+		if j != i && !r.done[j] {
+			r.canceled[j] = true
+			cancel()
+		}
+	}
+	return true
+}
+
+// finish records that attempt i returned.
+func (r *to2Race) finish(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done[i] = true
+}
+
+// raceTransport claims the race for attempt i before sending
+// TO2.DeviceServiceInfoReady.
+type raceTransport struct {
+	fdo.Transport
+	race *to2Race
+	i    int
+}
+
+func (t raceTransport) Send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (uint8, io.ReadCloser, error) {
+	if msgType == protocol.TO2DeviceServiceInfoReadyMsgType && !t.race.claim(t.i) {
+		return 0, nil, errLostRace
+	}
+	return t.Transport.Send(ctx, msgType, msg, sess)
+}
+
+// raceTransferOwnership runs TO2 against up to -to2-concurrency Owner URLs at
+// a time, in order, and returns the credential of the first attempt to
+// succeed. Attempts canceled because another won are not counted as failures.
+func raceTransferOwnership(ctx context.Context, to2URLs []string, to1d *cose.Sign1[protocol.To1d, []byte], conf fdo.TO2Config) (*fdo.DeviceCredential, error) {
+	lastErr := errors.New("no owner URL to try")
+	for len(to2URLs) > 0 {
+		var batch []string
+		for len(to2URLs) > 0 && len(batch) < to2Concurrency {
+			if ownerCircuit.Allow(to2URLs[0]) {
+				batch = append(batch, to2URLs[0])
+			}
+			to2URLs = to2URLs[1:]
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx)
+		}
+
+		onboardMetrics.To2Attempts += len(batch)
+		sdStatus("Running TO2 with " + strings.Join(batch, ", "))
+		race := newTo2Race(len(batch))
+		creds := make([]*fdo.DeviceCredential, len(batch))
+		errs := make([]error, len(batch))
+		// Every cancel func is set before the first attempt starts, as an
+		// attempt may claim the race and cancel the others at any time
+		attemptCtxs := make([]context.Context, len(batch))
+		for i := range batch {
+			attemptCtxs[i], race.cancels[i] = context.WithCancel(ctx)
+		}
+		var wg sync.WaitGroup
+		for i, baseURL := range batch {
+			transport := raceTransport{Transport: raceOwnerTransport(baseURL), race: race, i: i}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer race.cancels[i]()
+				creds[i], errs[i] = raceAttempt(attemptCtxs[i], transport, to1d, attemptConf(conf))
+				race.finish(i)
+			}()
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return nil, ctxError(ctx)
+		}
+
+		permanent := false
+		for i, baseURL := range batch {
+			if race.canceled[i] {
+				slog.Debug("TO2 attempt canceled, another owner URL won", "base URL", baseURL)
+				continue
+			}
+			recordEvent(reportEvent{Event: "TO2", URL: baseURL}, errs[i])
+			if errs[i] != nil {
+				slog.Error("TO2 failed", "base URL", baseURL, "error", errs[i])
+				ownerCircuit.Failure(baseURL)
+				lastErr = errs[i]
+				permanent = permanent || (retryOn == "transient" && isPermanent(errs[i]))
+				continue
+			}
+			// A nil credential without error means the Credential Reuse
+			// Protocol was used
+			ownerCircuit.Success(baseURL)
+			return creds[i], nil
+		}
+		if permanent {
+			slog.Error("TO2 failed with a permanent error, not trying other owner URLs")
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %w", errTO2Failed, lastErr)
+}
+
+// attemptConf returns conf with HMACs of its own for a concurrent TO2
+// attempt, as a hash.Hash cannot be shared between goroutines.
+func attemptConf(conf fdo.TO2Config) fdo.TO2Config {
+	conf.HmacSha256 = attemptHmac(conf.HmacSha256, sha256.New)
+	conf.HmacSha384 = attemptHmac(conf.HmacSha384, sha512.New384)
+	return conf
+}
+
+func attemptHmac(h hash.Hash, newHash func() hash.Hash) hash.Hash {
+	switch h := h.(type) {
+	case nil:
+		return nil
+	case disabledHmac:
+		return disabledHmac{Hash: attemptHmac(h.Hash, newHash), alg: h.alg}
+	}
+	return hmac.New(newHash, to2HmacSecret)
+}
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/cose"
+	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// fakeOwner answers TO2.HelloDevice with hello and counts the
+// TO2.DeviceServiceInfoReady messages which reach it.
+type fakeOwner struct {
+	name  string
+	hello func(context.Context) error
+	ready *atomic.Int32
+}
+
+func (o fakeOwner) Send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (uint8, io.ReadCloser, error) {
+	switch msgType {
+	case protocol.TO2HelloDeviceMsgType:
+		if err := o.hello(ctx); err != nil {
+			return 0, nil, err
+		}
+	case protocol.TO2DeviceServiceInfoReadyMsgType:
+		o.ready.Add(1)
+	}
+	return msgType, io.NopCloser(strings.NewReader(o.name)), nil
+}
+
+// fakeTO2 sends TO2.HelloDevice and TO2.DeviceServiceInfoReady and returns a
+// credential named after the owner which answered.
+func fakeTO2(ctx context.Context, transport fdo.Transport, to1d *cose.Sign1[protocol.To1d, []byte], conf fdo.TO2Config) (*fdo.DeviceCredential, error) {
+	if _, _, err := transport.Send(ctx, protocol.TO2HelloDeviceMsgType, nil, nil); err != nil {
+		return nil, err
+	}
+	_, body, err := transport.Send(ctx, protocol.TO2DeviceServiceInfoReadyMsgType, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = body.Close() }()
+	name, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return &fdo.DeviceCredential{DeviceInfo: string(name)}, nil
+}
+
+func TestRaceTransferOwnership(t *testing.T) {
+	defer func(transport func(string) fdo.Transport, attempt func(context.Context, fdo.Transport, *cose.Sign1[protocol.To1d, []byte], fdo.TO2Config) (*fdo.DeviceCredential, error)) {
+		raceOwnerTransport, raceAttempt = transport, attempt
+	}(raceOwnerTransport, raceAttempt)
+	defer func(n int, cb *circuitBreaker) { to2Concurrency, ownerCircuit = n, cb }(to2Concurrency, ownerCircuit)
+	resetRun()
+	to2Concurrency, ownerCircuit = 3, newCircuitBreaker(1, time.Minute)
+
+	// The first batch fails, the second has a single winner: slow is still
+	// waiting for its owner and late has not sent ServiceInfoReady yet
+	var ready atomic.Int32
+	var slowCanceled atomic.Bool
+	claimed := make(chan struct{})
+	failing := func(context.Context) error { return errors.New("owner unavailable") }
+	owners := map[string]fakeOwner{
+		"fail1": {hello: failing},
+		"fail2": {hello: failing},
+		"fail3": {hello: failing},
+		"slow": {hello: func(ctx context.Context) error {
+			<-ctx.Done()
+			slowCanceled.Store(true)
+			return ctx.Err()
+		}},
+		"fast": {hello: func(context.Context) error { return nil }},
+		"late": {hello: func(context.Context) error { <-claimed; return nil }},
+	}
+	raceOwnerTransport = func(baseURL string) fdo.Transport {
+		o := owners[baseURL]
+		o.name, o.ready = baseURL, &ready
+		if baseURL == "fast" {
+			return closeOnReady{fakeOwner: o, claimed: claimed}
+		}
+		return o
+	}
+	raceAttempt = fakeTO2
+
+	cred, err := raceTransferOwnership(context.Background(), []string{"fail1", "fail2", "fail3", "slow", "fast", "late"}, nil, fdo.TO2Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.DeviceInfo != "fast" {
+		t.Errorf("expected the credential of fast, got %q", cred.DeviceInfo)
+	}
+	if n := ready.Load(); n != 1 {
+		t.Errorf("expected one ServiceInfoReady to reach an owner, got %d", n)
+	}
+	if !slowCanceled.Load() {
+		t.Error("slow attempt was not canceled")
+	}
+	for _, url := range []string{"slow", "fast", "late"} {
+		if !ownerCircuit.Allow(url) {
+			t.Errorf("%s counted as a failure", url)
+		}
+	}
+	if ownerCircuit.Allow("fail1") {
+		t.Error("fail1 not counted as a failure")
+	}
+	if n := onboardMetrics.To2Attempts; n != 6 {
+		t.Errorf("expected 6 TO2 attempts, got %d", n)
+	}
+}
+
+// closeOnReady closes claimed once its TO2.DeviceServiceInfoReady reached the
+// owner, which lets the late attempt continue.
+type closeOnReady struct {
+	fakeOwner
+	claimed chan struct{}
+}
+
+func (o closeOnReady) Send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (uint8, io.ReadCloser, error) {
+	msgType, body, err := o.fakeOwner.Send(ctx, msgType, msg, sess)
+	if msgType == protocol.TO2DeviceServiceInfoReadyMsgType {
+		close(o.claimed)
+	}
+	return msgType, body, err
+}
@@ -0,0 +1,327 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/cose"
+	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// Errors of the voucher subcommand, mapped to exit codes in main.
+var (
+	errUsage          = errors.New("invalid usage")
+	errVoucherBroken  = errors.New("voucher entry chain is broken")
+	errVoucherHashAlg = errors.New("voucher uses an unsupported hash algorithm")
+	errVoucherTooLong = errors.New("voucher has too many entries")
+)
+
+// voucherCommand runs "fdo_client voucher <subcommand> [flags] <file>...".
+// The subcommands are verify and chain.
+func voucherCommand(args []string) error {
+	if len(args) > 0 && args[0] == "chain" {
+		return voucherChainCommand(args[1:])
+	}
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: fdo_client voucher verify [-max-entries n] <file>...")
+		fmt.Fprintln(os.Stderr, "       fdo_client voucher chain -in <file> [-dot] [-force]")
+		return errUsage
+	}
+
+	verifyFlags := flag.NewFlagSet("voucher verify", flag.ContinueOnError)
+	maxEntries := verifyFlags.Int("max-entries", -1, "Fail if a voucher has more than `n` entries (no limit if negative)")
+	verifyFlags.Usage = func() {
+		fmt.Fprintln(verifyFlags.Output(), "Usage: fdo_client voucher verify [-max-entries n] <file>...")
+		verifyFlags.PrintDefaults()
+	}
+	addLogFlags(verifyFlags)
+	if err := verifyFlags.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+	if err := setupLogging(); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if verifyFlags.NArg() == 0 {
+		verifyFlags.Usage()
+		return errUsage
+	}
+
+	var errs []error
+	for _, path := range verifyFlags.Args() {
+		if err := verifyVoucherFile(path, *maxEntries); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// verifyVoucherFile reads a PEM or CBOR encoded voucher, prints the owner key
+// type of each entry and verifies the entry chain from the manufacturer key to
+// the current owner.
+//
+// The voucher header HMAC can only be verified with the device secret, so it
+// is not checked.
+func verifyVoucherFile(path string, maxEntries int) error {
+	ov, err := readVoucher(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n  GUID          %x\n  DeviceInfo    %q\n  Manufacturer  %s\n  Entries       %d\n",
+		path, ov.Header.Val.GUID, ov.Header.Val.DeviceInfo, ov.Header.Val.ManufacturerKey.Type, len(ov.Entries))
+	for i, entry := range ov.Entries {
+		key := entry.Payload.Val.PublicKey
+		fmt.Printf("  Entry %-7d %s (%s), hashed with %s\n", i, key.Type, key.Encoding, entry.Payload.Val.PreviousHash.Algorithm)
+	}
+
+	if maxEntries >= 0 && len(ov.Entries) > maxEntries {
+		return fmt.Errorf("%w: %d entries exceed -max-entries %d", errVoucherTooLong, len(ov.Entries), maxEntries)
+	}
+
+	if err := ov.VerifyEntries(); err != nil {
+		return verifyEntriesError(err)
+	}
+	fmt.Println("  Entry chain   valid")
+	return nil
+}
+
+// verifyEntriesError returns the error of a voucher whose entry chain failed
+// verification, wrapping errVoucherBroken or errVoucherHashAlg for their exit
+// codes.
+func verifyEntriesError(err error) error {
+	err = libError(err)
+	switch {
+	case errors.Is(err, fdo.ErrCryptoVerifyFailed):
+		return fmt.Errorf("%w: %w", errVoucherBroken, err)
+	case errors.Is(err, errUnsupportedHash):
+		return fmt.Errorf("%w: %w", errVoucherHashAlg, err)
+	}
+	return fmt.Errorf("error verifying voucher entries: %w", err)
+}
+
+// voucherChainCommand runs "fdo_client voucher chain -in <file>", which
+// prints the manufacturer key and the owner key of each voucher entry, in
+// order of transfer, with their type, encoding and SHA-256 fingerprint. The
+// chain is verified first and an invalid voucher is not printed unless -force
+// is given.
+func voucherChainCommand(args []string) error {
+	chainFlags := flag.NewFlagSet("voucher chain", flag.ContinueOnError)
+	in := chainFlags.String("in", "", "PEM or CBOR voucher `file` to read")
+	dot := chainFlags.Bool("dot", false, "Print the chain as a Graphviz DOT graph")
+	force := chainFlags.Bool("force", false, "Print the chain of a voucher which fails verification")
+	chainFlags.Usage = func() {
+		fmt.Fprintln(chainFlags.Output(), "Usage: fdo_client voucher chain -in <file> [-dot] [-force]")
+		chainFlags.PrintDefaults()
+	}
+	addLogFlags(chainFlags)
+	if err := chainFlags.Parse(args); err != nil {
+		return errUsage
+	}
+	if err := setupLogging(); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if *in == "" || chainFlags.NArg() > 0 {
+		chainFlags.Usage()
+		return errUsage
+	}
+
+	ov, err := readVoucher(*in)
+	if err != nil {
+		return err
+	}
+	verifyErr := ov.VerifyEntries()
+	if verifyErr != nil {
+		verifyErr = verifyEntriesError(verifyErr)
+		if !*force {
+			return verifyErr
+		}
+		slog.Warn("Printing the chain of a voucher which failed verification", "error", verifyErr)
+	}
+
+	keys := []protocol.PublicKey{ov.Header.Val.ManufacturerKey}
+	for _, entry := range ov.Entries {
+		keys = append(keys, entry.Payload.Val.PublicKey)
+	}
+	nodes := make([]string, len(keys))
+	for i, key := range keys {
+		name := "Manufacturer"
+		if i > 0 {
+			name = fmt.Sprintf("Owner %d", i)
+		}
+		fingerprint := "<invalid key>"
+		if pub, err := key.Public(); err == nil {
+			if fingerprint, err = keyFingerprint(pub); err != nil {
+				return err
+			}
+		}
+		if *dot {
+			nodes[i] = fmt.Sprintf("%s\\n%s (%s)\\n%s", name, key.Type, key.Encoding, fingerprint)
+			continue
+		}
+		nodes[i] = fmt.Sprintf("%-14s%s (%s) SHA-256 %s", name, key.Type, key.Encoding, fingerprint)
+	}
+
+	if !*dot {
+		fmt.Printf("%s\n  GUID          %x\n", *in, ov.Header.Val.GUID)
+		for _, node := range nodes {
+			fmt.Printf("  %s\n", node)
+		}
+		return verifyErr
+	}
+	fmt.Printf("digraph voucher {\n\trankdir=LR;\n\tlabel=\"GUID %x\";\n\tnode [shape=box];\n", ov.Header.Val.GUID)
+	for i, node := range nodes {
+		fmt.Printf("\tn%d [label=\"%s\"];\n", i, node)
+	}
+	for i := 1; i < len(nodes); i++ {
+		fmt.Printf("\tn%d -> n%d;\n", i-1, i)
+	}
+	fmt.Println("}")
+	return verifyErr
+}
+
+// readVoucher decodes a voucher from a file containing either an "OWNERSHIP
+// VOUCHER" PEM block, as exported by FDO servers, or its CBOR encoding.
+func readVoucher(path string) (*fdo.Voucher, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading voucher: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "OWNERSHIP VOUCHER" {
+			return nil, fmt.Errorf("error reading voucher: unexpected PEM block %q", block.Type)
+		}
+		data = block.Bytes
+	}
+	var ov fdo.Voucher
+	if err := cbor.Unmarshal(data, &ov); err != nil {
+		return nil, fmt.Errorf("error parsing voucher: %w", err)
+	}
+	return &ov, nil
+}
+
+// voucherTransport inspects the voucher the owner sends in TO2. It fails TO2
+// with errVoucherTooLong when TO2.ProveOVHdr reports more than
+// -max-voucher-entries voucher entries, before any entry is fetched with
+// TO2.GetOVNextEntry and verified. With -dump-voucher, it writes the voucher
+// once its last entry is received, before the client verifies it.
+type voucherTransport struct {
+	fdo.Transport
+
+	ov         *fdo.Voucher
+	numEntries int
+}
+
+func (t *voucherTransport) Send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (uint8, io.ReadCloser, error) {
+	respType, body, err := t.Transport.Send(ctx, msgType, msg, sess)
+	if err != nil || (respType != protocol.TO2ProveOVHdrMsgType && (respType != protocol.TO2OVNextEntryMsgType || t.ov == nil)) {
+		return respType, body, err
+	}
+	defer func() { _ = body.Close() }()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading TO2 message %d: %w", respType, err)
+	}
+
+	if respType == protocol.TO2ProveOVHdrMsgType {
+		if err := t.proveOVHdr(data); err != nil {
+			return 0, nil, err
+		}
+	} else {
+		t.ovNextEntry(data)
+	}
+	return respType, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// proveOVHdr checks the number of voucher entries of TO2.ProveOVHdr and, for
+// -dump-voucher, starts the voucher from its header and HMAC.
+func (t *voucherTransport) proveOVHdr(data []byte) error {
+	// Only the header, entry count and HMAC, the first fields of the
+	// payload, are decoded. The library parses and verifies the rest of the
+	// message.
+	var proveOVHdr cose.Sign1Tag[[]cbor.RawBytes, []byte]
+	if err := cbor.Unmarshal(data, &proveOVHdr); err != nil {
+		return fmt.Errorf("error parsing TO2.ProveOVHdr: %w", err)
+	}
+	if proveOVHdr.Payload == nil || len(proveOVHdr.Payload.Val) < 3 {
+		return fmt.Errorf("error parsing TO2.ProveOVHdr: payload is missing the voucher header, entries or HMAC")
+	}
+	var numEntries uint8
+	if err := cbor.Unmarshal(proveOVHdr.Payload.Val[1], &numEntries); err != nil {
+		return fmt.Errorf("error parsing number of voucher entries in TO2.ProveOVHdr: %w", err)
+	}
+	if int(numEntries) > maxOVEntries {
+		return fmt.Errorf("%w: owner reports %d entries, more than -max-voucher-entries %d", errVoucherTooLong, numEntries, maxOVEntries)
+	}
+	if dumpVoucher == "" {
+		return nil
+	}
+
+	// A voucher which cannot be dumped is left for the library to reject
+	var ov fdo.Voucher
+	if err := cbor.Unmarshal(proveOVHdr.Payload.Val[0], &ov.Header); err != nil {
+		slog.Error("Dumping voucher failed", "error", fmt.Errorf("error parsing voucher header: %w", err))
+		return nil
+	}
+	if err := cbor.Unmarshal(proveOVHdr.Payload.Val[2], &ov.Hmac); err != nil {
+		slog.Error("Dumping voucher failed", "error", fmt.Errorf("error parsing voucher header HMAC: %w", err))
+		return nil
+	}
+	ov.Version = ov.Header.Val.Version
+	t.ov, t.numEntries = &ov, int(numEntries)
+	if t.numEntries == 0 {
+		t.dump()
+	}
+	return nil
+}
+
+// ovNextEntry adds the entry of TO2.OVNextEntry to the voucher to dump.
+func (t *voucherTransport) ovNextEntry(data []byte) {
+	var next struct {
+		OVEntryNum int
+		OVEntry    cose.Sign1Tag[fdo.VoucherEntryPayload, []byte]
+	}
+	if err := cbor.Unmarshal(data, &next); err != nil {
+		slog.Error("Dumping voucher failed", "error", fmt.Errorf("error parsing TO2.OVNextEntry: %w", err))
+		t.ov = nil
+		return
+	}
+	t.ov.Entries = append(t.ov.Entries, next.OVEntry)
+	if len(t.ov.Entries) == t.numEntries {
+		t.dump()
+	}
+}
+
+// dump writes the voucher to -dump-voucher. Failures are logged without
+// failing TO2.
+func (t *voucherTransport) dump() {
+	if err := saveVoucherFile(dumpVoucher, t.ov); err != nil {
+		slog.Error("Dumping voucher failed", "error", err)
+	} else {
+		slog.Info("Voucher received in TO2 written", "path", dumpVoucher, "entries", len(t.ov.Entries))
+	}
+	t.ov = nil
+}
+
+// saveVoucherFile atomically writes a CBOR encoded voucher to path.
+func saveVoucherFile(path string, ov *fdo.Voucher) error {
+	return writeFileAtomic(path, 0o600, func(w io.Writer) error {
+		if err := cbor.NewEncoder(w).Encode(ov); err != nil {
+			return fmt.Errorf("error encoding voucher: %w", err)
+		}
+		return nil
+	})
+}
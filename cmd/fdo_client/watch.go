@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Polling interval of -watch and the time the credential blobs must be
+// unchanged before onboarding is run again, so that a blob being rewritten in
+// several steps triggers a single run.
+const (
+	watchInterval = time.Second
+	watchSettle   = 2 * time.Second
+)
+
+// watchBlobs runs the client, then waits for a -blob path to be replaced or
+// modified and runs it again, until interrupted. Each run is limited by
+// -deadline, waiting for a change is not.
+func watchBlobs() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for {
+		if err := clientEach(); err != nil {
+			slog.Error("Onboarding failed", "error", err)
+		}
+		slog.Info("Waiting for device credential change", "blob", blobPaths.paths)
+		if err := waitForChange(ctx, blobPaths.paths); err != nil {
+			return nil
+		}
+		slog.Info("Device credential changed, onboarding again")
+	}
+}
+
+// waitForChange polls paths until any of them is created, removed, replaced or
+// modified and then left unchanged for watchSettle.
+func waitForChange(ctx context.Context, paths []string) error {
+	last := statAll(paths)
+	var changedAt time.Time
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		current := statAll(paths)
+		if !sameStats(last, current) {
+			last, changedAt = current, time.Now()
+			continue
+		}
+		if !changedAt.IsZero() && time.Since(changedAt) >= watchSettle {
+			return nil
+		}
+	}
+}
+
+func statAll(paths []string) []os.FileInfo {
+	infos := make([]os.FileInfo, len(paths))
+	for i, path := range paths {
+		infos[i], _ = os.Stat(path)
+	}
+	return infos
+}
+
+func sameStats(a, b []os.FileInfo) bool {
+	for i := range a {
+		switch {
+		case a[i] == nil || b[i] == nil:
+			if a[i] != b[i] {
+				return false
+			}
+		case !os.SameFile(a[i], b[i]), !a[i].ModTime().Equal(b[i].ModTime()), a[i].Size() != b[i].Size():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo-client/internal/tls"
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// wgetClient is the HTTP client of the fdo.wget FSIM. Its TLS settings are
+// configured by -wget-insecure-tls and -wget-ca rather than by the flags for
+// FDO protocol connections.
+var wgetClient *http.Client
+
+// newWgetClient returns the HTTP client for fdo.wget fetches. Certificates are
+// verified against the system roots, or the -wget-ca bundle if given.
+func newWgetClient() (*http.Client, error) {
+	conf := &cryptotls.Config{
+		MinVersion:         cryptotls.VersionTLS12,
+		InsecureSkipVerify: wgetInsecureTLS, //nolint:gosec
+	}
+	if wgetCA != "" {
+		pem, err := os.ReadFile(filepath.Clean(wgetCA))
+		if err != nil {
+			return nil, fmt.Errorf("error reading wget CA bundle %q: %w", wgetCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in wget CA bundle %q", wgetCA)
+		}
+		conf.RootCAs = pool
+	}
+	client := tls.HTTPClient(conf, wgetInsecureTLS)
+	if len(wgetAllowHosts) > 0 {
+		client.Transport = allowHostsRoundTripper{base: client.Transport, hosts: wgetAllowHosts}
+	}
+	if fsimRate != nil {
+		client.Transport = rateRoundTripper{base: client.Transport, l: fsimRate}
+	}
+	return client, nil
+}
+
+// hostsVar is the flag value of -wget-allow-host.
+type hostsVar []string
+
+func (h *hostsVar) String() string { return strings.Join(*h, ",") }
+
+func (h *hostsVar) Set(hosts string) error {
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !isValidHostname(host) && net.ParseIP(host) == nil {
+			return fmt.Errorf("[%q]: invalid hostname", host)
+		}
+		*h = append(*h, host)
+	}
+	return nil
+}
+
+// allowHostsRoundTripper rejects requests, including redirects, to hosts not
+// in its allow-list.
+type allowHostsRoundTripper struct {
+	base  http.RoundTripper
+	hosts []string
+}
+
+func (rt allowHostsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if host := strings.ToLower(req.URL.Hostname()); !slices.Contains(rt.hosts, host) {
+		slog.Warn("Rejected fdo.wget fetch from host not in -wget-allow-host", "url", req.URL.Redacted())
+		return nil, fmt.Errorf("fdo.wget host %q is not allowed", host)
+	}
+	return rt.base.RoundTrip(req)
+}
+
+// wgetChecksumModule rejects fdo.wget downloads for which the owner sent no
+// SHA-384 checksum, for -wget-checksum-required. Checksums which are sent are
+// always verified by fdo.wget, which removes the file if it does not match.
+type wgetChecksumModule struct {
+	serviceinfo.DeviceModule
+	hasChecksum bool
+}
+
+func (m *wgetChecksumModule) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	switch messageName {
+	case "sha-384":
+		data, err := io.ReadAll(messageBody)
+		if err != nil {
+			return err
+		}
+		var sum []byte
+		m.hasChecksum = cbor.Unmarshal(data, &sum) == nil && len(sum) > 0
+		messageBody = bytes.NewReader(data)
+	case "url":
+		hasChecksum := m.hasChecksum
+		m.hasChecksum = false
+		if !hasChecksum {
+			msg := "owner sent no sha-384 checksum and -wget-checksum-required is set"
+			_, _ = fmt.Fprintln(slogErrorWriter{module: "fdo.wget"}, msg)
+			return cbor.NewEncoder(respond("error")).Encode(msg)
+		}
+	}
+	return m.DeviceModule.Receive(ctx, messageName, messageBody, respond, yield)
+}
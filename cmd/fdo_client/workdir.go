@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// createWorkingDirs creates the dirs the client writes files into, if they do
+// not exist, for -create-working-dir.
+func createWorkingDirs(mode os.FileMode) error {
+	dirs := []string{dlDir, wgetDir, outputDir}
+	for _, path := range blobPaths.paths {
+		if tpmPath == "" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+	for _, dir := range dirs {
+		if dir == "" || fileExists(dir) {
+			continue
+		}
+		if !isValidPath(dir) {
+			return fmt.Errorf("invalid working directory: %s", dir)
+		}
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return fmt.Errorf("error creating working directory: %w", err)
+		}
+		slog.Info("Created working directory", "path", dir)
+	}
+	return nil
+}
+
+// checkWorkingDirs checks that -download and -wget-dir are writable dirs and
+// makes them absolute. All problems are reported together, so that they can be
+// fixed in one pass.
+func checkWorkingDirs() error {
+	var errs []error
+	for _, dir := range []struct {
+		name string
+		path *string
+	}{
+		{"download", &dlDir},
+		{"wget", &wgetDir},
+	} {
+		if *dir.path == "" {
+			continue
+		}
+		if err := checkWritableDir(*dir.path); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s directory: %w", dir.name, err))
+			continue
+		}
+		*dir.path, _ = filepath.Abs(*dir.path)
+	}
+	return errors.Join(errs...)
+}
+
+// checkWritableDir checks that path is a dir a file can be created in.
+func checkWritableDir(path string) error {
+	if !isValidPath(path) {
+		return fmt.Errorf("%s: invalid path", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", path)
+	}
+	f, err := os.CreateTemp(path, ".fdo-write-test-*")
+	if err != nil {
+		return fmt.Errorf("%s: not writable: %w", path, err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
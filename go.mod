@@ -3,10 +3,14 @@ module github.com/fido-device-onboard/go-fdo-client
 go 1.23.0
 
 require (
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/fido-device-onboard/go-fdo v0.0.0-20241024181140-1fef581454b4
 	github.com/fido-device-onboard/go-fdo/fsim v0.0.0-20241024181140-1fef581454b4
 	github.com/fido-device-onboard/go-fdo/tpm v0.0.0-20241024181140-1fef581454b4
 	github.com/google/go-tpm v0.9.2-0.20240920144513-364d5f2f78b9
+	github.com/miekg/pkcs11 v1.0.3-0.20190429190417-a667d056470f
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.30.0
 	hermannm.dev/devlog v0.5.0
 )
 
@@ -14,6 +18,8 @@ require (
 	github.com/google/go-configfs-tsm v0.3.2 // indirect
 	github.com/google/go-tpm-tools v0.4.4 // indirect
 	github.com/neilotoole/jsoncolor v0.7.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/thales-e-security/pool v0.0.2 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/term v0.25.0 // indirect
 )
@@ -4,43 +4,240 @@
 package tls
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
 	net_http "net/http"
+	"sync"
 	"time"
 
 	"github.com/fido-device-onboard/go-fdo"
 	"github.com/fido-device-onboard/go-fdo/http"
+	"golang.org/x/net/proxy"
 )
 
+// LocalAddr, if set, is the local address outbound connections are made from.
+var LocalAddr net.Addr
+
+// Socks5Addr, if set, is the host:port of a SOCKS5 proxy all connections are
+// made through, with the optional Socks5Auth credentials. Host names are
+// resolved by the proxy.
+var (
+	Socks5Addr string
+	Socks5Auth *proxy.Auth
+)
+
+// PinIP, if set, makes each client returned by HTTPClient resolve a host name
+// only once and connect to the same IP for all of its requests, so that a
+// multi-message session is not split across backends by round-robin DNS.
+var PinIP bool
+
+// LookupHost, if set, resolves the host names of PinIP connections instead of
+// the system resolver.
+var LookupHost func(ctx context.Context, host string) ([]string, error)
+
+// SessionCache, if set, is used by the transports of TlsTransport and
+// HeaderTransport, so that connections for later FDO messages of the run, such
+// as TO2 after TO1 and retries, resume the TLS session instead of doing a full
+// handshake.
+var SessionCache tls.ClientSessionCache
+
 func TlsTransport(baseURL string, conf *tls.Config, insecureTLS bool) fdo.Transport {
+	return &http.Transport{
+		BaseURL: baseURL,
+		Client:  HTTPClient(protocolConfig(conf, insecureTLS), insecureTLS),
+	}
+}
+
+// SkipCertTime, if set, makes the transports of TlsTransport and
+// HeaderTransport verify server certificates as of the time the certificates
+// were issued instead of the current time, for devices with no reliable clock.
+// The chain and host name are still verified.
+var SkipCertTime bool
+
+// protocolConfig returns conf, or the default config if nil, with the
+// SessionCache and SkipCertTime settings of FDO protocol transports applied
+// to a copy.
+func protocolConfig(conf *tls.Config, insecureTLS bool) *tls.Config {
+	useCache := SessionCache != nil && (conf == nil || conf.ClientSessionCache == nil)
+	skipTime := SkipCertTime && !insecureTLS && (conf == nil || !conf.InsecureSkipVerify)
+	if !useCache && !skipTime {
+		return conf
+	}
+	if conf == nil {
+		conf = DefaultConfig(insecureTLS)
+	} else {
+		conf = conf.Clone()
+	}
+	if useCache {
+		conf.ClientSessionCache = SessionCache
+	}
+	if skipTime {
+		// Verification is done by VerifyConnection instead
+		conf.InsecureSkipVerify = true //nolint:gosec
+		conf.VerifyConnection = verifyIgnoringTime(conf.RootCAs)
+	}
+	return conf
+}
+
+// verifyIgnoringTime returns a VerifyConnection func which verifies the server
+// chain and name like the default verification, but at the latest NotBefore
+// time of the certificates presented instead of the current time.
+func verifyIgnoringTime(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("tls: server presented no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			DNSName:       cs.ServerName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates {
+			if cert.NotBefore.After(opts.CurrentTime) {
+				opts.CurrentTime = cert.NotBefore
+			}
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+			return &tls.CertificateVerificationError{UnverifiedCertificates: cs.PeerCertificates, Err: err}
+		}
+		return nil
+	}
+}
+
+// HTTPClient returns an HTTP client with the same connection and TLS settings
+// as used for FDO protocol messages.
+func HTTPClient(conf *tls.Config, insecureTLS bool) *net_http.Client {
+	if conf == nil {
+		conf = DefaultConfig(insecureTLS)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: LocalAddr,
+	}
+	dial := dialer.DialContext
+	httpProxy := net_http.ProxyFromEnvironment
+	switch {
+	case Socks5Addr != "":
+		// SOCKS5 never fails to be created for TCP and its dialer always
+		// implements ContextDialer
+		socks, _ := proxy.SOCKS5("tcp", Socks5Addr, Socks5Auth, dialer)
+		dial = socks.(proxy.ContextDialer).DialContext
+		httpProxy = nil
+	case PinIP:
+		dial = (&pinnedDialer{dialer: dialer}).DialContext
+	}
+
+	// HTTP/2 is offered by ALPN despite the custom dialer and TLS config, with
+	// HTTP/1.1 used by servers which do not select it
+	return &net_http.Client{Transport: &net_http.Transport{
+		Proxy:                 httpProxy,
+		DialContext:           dial,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSClientConfig:       conf,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}}
+}
+
+// DefaultConfig returns the TLS settings used for FDO protocol messages when
+// no config is given, for callers which only need to change some of them.
+func DefaultConfig(insecureTLS bool) *tls.Config {
 	preferredCipherSuites := []uint16{
 		tls.TLS_AES_256_GCM_SHA384,                  // TLS v1.3
 		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,   // TLS v1.2
 		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, // TLS v1.2
 	}
-
-	if conf == nil {
-		conf = &tls.Config{
-			CipherSuites:       preferredCipherSuites,
-			InsecureSkipVerify: insecureTLS, //nolint:gosec
-		}
+	return &tls.Config{
+		CipherSuites:       preferredCipherSuites,
+		InsecureSkipVerify: insecureTLS, //nolint:gosec
 	}
+}
 
+// HeaderTransport is like TlsTransport, but adds header to every request.
+func HeaderTransport(baseURL string, conf *tls.Config, insecureTLS bool, header net_http.Header) fdo.Transport {
 	return &http.Transport{
 		BaseURL: baseURL,
-		Client: &net_http.Client{Transport: &net_http.Transport{
-			Proxy: net_http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSClientConfig:       conf,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}},
+		Client:  HTTPClientWithHeaders(protocolConfig(conf, insecureTLS), insecureTLS, header),
+	}
+}
+
+// HTTPClientWithHeaders is like HTTPClient, but adds header to every request.
+func HTTPClientWithHeaders(conf *tls.Config, insecureTLS bool, header net_http.Header) *net_http.Client {
+	client := HTTPClient(conf, insecureTLS)
+	if len(header) > 0 {
+		client.Transport = headerRoundTripper{base: client.Transport, header: header}
+	}
+	return client
+}
+
+type headerRoundTripper struct {
+	base   net_http.RoundTripper
+	header net_http.Header
+}
+
+func (rt headerRoundTripper) RoundTrip(req *net_http.Request) (*net_http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range rt.header {
+		req.Header[name] = values
+	}
+	return rt.base.RoundTrip(req)
+}
+
+// pinnedDialer connects to the first IP of a host to accept a connection and
+// reuses that IP for every later connection to the host.
+type pinnedDialer struct {
+	dialer *net.Dialer
+
+	mu     sync.Mutex
+	pinned map[string]string
+}
+
+func (d *pinnedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	d.mu.Lock()
+	ip, ok := d.pinned[host]
+	d.mu.Unlock()
+	if ok {
+		return d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+	}
+
+	lookup := net.DefaultResolver.LookupHost
+	if LookupHost != nil {
+		lookup = LookupHost
+	}
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err != nil {
+			continue
+		}
+		d.mu.Lock()
+		if d.pinned == nil {
+			d.pinned = make(map[string]string)
+		}
+		if _, ok := d.pinned[host]; !ok {
+			d.pinned[host] = ip
+		}
+		d.mu.Unlock()
+		return conn, nil
 	}
+	return nil, err
 }
@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package tls
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestPinnedDialerLookupHost(t *testing.T) {
+	defer func(lookup func(context.Context, string) ([]string, error)) { LookupHost = lookup }(LookupHost)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var lookups int
+	LookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		if host != "owner.invalid" {
+			t.Errorf("unexpected lookup of %q", host)
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+
+	d := &pinnedDialer{dialer: &net.Dialer{}}
+	for range 2 {
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("owner.invalid", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+	if lookups != 1 {
+		t.Errorf("expected the host to be resolved once with LookupHost, got %d lookups", lookups)
+	}
+}
@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package tpm_utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"syscall"
+)
+
+// TPMDEVICES are the TPM device paths which may be opened.
+var TPMDEVICES = []string{"/dev/tpm0", "/dev/tpmrm0"}
+
+// CheckTpmPath returns an error explaining how to fix a TPM path which cannot
+// be opened: an unsupported path, a device which does not exist or one the
+// user may not open. Other failures, such as a busy device, are left to
+// TpmOpen.
+func CheckTpmPath(tpmPath string) error {
+	if tpmPath == "simulator" {
+		if !simulatorSupported {
+			return fmt.Errorf("the TPM simulator requires a client built with -tags tpmsim")
+		}
+		return nil
+	}
+	if !slices.Contains(TPMDEVICES, tpmPath) {
+		return fmt.Errorf("unsupported TPM device path %q: use /dev/tpmrm0 (the kernel resource manager, recommended), /dev/tpm0 or simulator", tpmPath)
+	}
+
+	info, err := os.Stat(tpmPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		for _, other := range TPMDEVICES {
+			if other != tpmPath && deviceExists(other) {
+				return fmt.Errorf("TPM device %s does not exist, but %s does", tpmPath, other)
+			}
+		}
+		return fmt.Errorf("TPM device %s does not exist: check that the TPM is enabled in the firmware settings and its kernel driver (tpm_tis or tpm_crb) is loaded", tpmPath)
+	case err != nil:
+		return fmt.Errorf("error checking TPM device %s: %w", tpmPath, err)
+	case info.Mode()&fs.ModeCharDevice == 0:
+		return fmt.Errorf("%s is not a TPM device", tpmPath)
+	}
+
+	f, err := os.OpenFile(tpmPath, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("permission denied opening TPM device %s: %s", tpmPath, permissionHint(info))
+	}
+	if err == nil {
+		_ = f.Close()
+	}
+	return nil
+}
+
+func deviceExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&fs.ModeCharDevice != 0
+}
+
+// permissionHint suggests how to get access to a TPM device, based on the
+// group owning it and whether the current user is a member.
+func permissionHint(info fs.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "run as root or as a member of the group owning the device"
+	}
+	if st.Gid == 0 {
+		return "the device is owned by root, so run as root or install the udev rules of tpm2-tss to give the tss group access"
+	}
+	gid := strconv.FormatUint(uint64(st.Gid), 10)
+	group := gid
+	if g, err := user.LookupGroupId(gid); err == nil {
+		group = g.Name
+	}
+	if u, err := user.Current(); err == nil {
+		if gids, err := u.GroupIds(); err == nil && slices.Contains(gids, gid) {
+			return fmt.Sprintf("the user is in the %s group owning the device, so check that the group may read and write it, and log in again if the user was just added", group)
+		}
+	}
+	return fmt.Sprintf("run as root or add the user to the %s group owning the device", group)
+}
@@ -6,22 +6,15 @@
 package tpm_utils
 
 import (
-	"fmt"
-	"slices"
-
 	"github.com/fido-device-onboard/go-fdo/tpm"
 )
 
-var TPMDEVICES = []string{"/dev/tpm0", "/dev/tpmrm0"}
+// simulatorSupported is whether "simulator" may be given as the TPM path.
+const simulatorSupported = false
 
 func TpmOpen(tpmPath string) (tpm.Closer, error) {
-	if tpmPath == "simulator" {
-		return nil, fmt.Errorf("tpm simulator is not supported")
-	}
-
-	if slices.Contains(TPMDEVICES, tpmPath) {
-		return tpm.Open(tpmPath)
+	if err := CheckTpmPath(tpmPath); err != nil {
+		return nil, err
 	}
-
-	return nil, fmt.Errorf("invalid tpm path")
+	return tpm.Open(tpmPath)
 }
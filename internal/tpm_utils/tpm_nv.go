@@ -5,6 +5,7 @@ package tpm_utils
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpm2/transport"
@@ -53,6 +54,15 @@ func TpmNVUnDefine(thetpm transport.TPM, nv tpm2.TPMHandle, nvName *tpm2.TPM2BNa
 	return nil
 }
 
+// TpmNVRemove undefines the specified NV index, whatever its attributes.
+func TpmNVRemove(thetpm transport.TPM, nv tpm2.TPMHandle) error {
+	readPubRsp, err := tpm2.NVReadPublic{NVIndex: nv}.Execute(thetpm)
+	if err != nil {
+		return fmt.Errorf("calling TPM2_NV_ReadPublic: %v", err)
+	}
+	return TpmNVUnDefine(thetpm, nv, &readPubRsp.NVName)
+}
+
 // TpmNVGetSize retrieves the size of the data stored in the specified NV index.
 func TpmNVGetSize(thetpm transport.TPM, nv tpm2.TPMHandle) uint16 {
 	readPub := tpm2.NVReadPublic{
@@ -71,43 +81,24 @@ func TpmNVGetSize(thetpm transport.TPM, nv tpm2.TPMHandle) uint16 {
 
 // TpmNVRead reads data from the specified NV index.
 func TpmNVRead(thetpm transport.TPM, nv tpm2.TPMHandle) ([]byte, error) {
-	readPub := tpm2.NVReadPublic{
-		NVIndex: nv,
-	}
-	readPubRsp, err := readPub.Execute(thetpm)
-	if err != nil {
-		return nil, fmt.Errorf("calling TPM2_NV_ReadPublic: %v", err)
-	}
-	nvPublic, err := readPubRsp.NVPublic.Contents()
-	if err != nil {
-		return nil, fmt.Errorf("getting NV public contents: %v", err)
-	}
-	dataSize := nvPublic.DataSize
+	return tpmNVReadChunked(thetpm, tpm2.TPMRHOwner, nv)
+}
 
-	nvName, err := tpm2.NVName(nvPublic)
+// TpmNVWrite writes data to the specified NV index, deleting existing data if present.
+func TpmNVWrite(thetpm transport.TPM, data []byte, nv tpm2.TPMHandle, tpmHashAlg tpm2.TPMAlgID) error {
+	// Check the data fits before removing any existing data
+	indexMax, err := tpmProperty(thetpm, tpm2.TPMPTNVIndexMax)
 	if err != nil {
-		return nil, fmt.Errorf("calculating name of NV index: %v", err)
+		return fmt.Errorf("getting maximum NV index size: %v", err)
 	}
-
-	read := tpm2.NVRead{
-		AuthHandle: tpm2.TPMRHOwner,
-		NVIndex: tpm2.NamedHandle{
-			Handle: nv,
-			Name:   *nvName,
-		},
-		Size:   dataSize,
-		Offset: 0,
+	if len(data) > int(indexMax) || len(data) > math.MaxUint16 {
+		return fmt.Errorf("credential is %d bytes but NV index holds at most %d", len(data), indexMax)
 	}
-	readRsp, err := read.Execute(thetpm)
+	bufferMax, err := tpmProperty(thetpm, tpm2.TPMPTNVBufferMax)
 	if err != nil {
-		return nil, fmt.Errorf("calling TPM2_NV_Read: %v", err)
+		return fmt.Errorf("getting maximum NV write size: %v", err)
 	}
 
-	return readRsp.Data.Buffer, nil
-}
-
-// TpmNVWrite writes data to the specified NV index, deleting existing data if present.
-func TpmNVWrite(thetpm transport.TPM, data []byte, nv tpm2.TPMHandle, tpmHashAlg tpm2.TPMAlgID) error {
 	// Check if data exists in the NV index
 	dataSize := TpmNVGetSize(thetpm, nv)
 
@@ -142,20 +133,108 @@ func TpmNVWrite(thetpm transport.TPM, data []byte, nv tpm2.TPMHandle, tpmHashAlg
 		return fmt.Errorf("defining NV index: %v", err)
 	}
 
-	// Write the new data to the NV index
-	write := tpm2.NVWrite{
-		AuthHandle: tpm2.TPMRHOwner,
-		NVIndex: tpm2.NamedHandle{
-			Handle: nv,
-			Name:   *nvName,
-		},
-		Data: tpm2.TPM2BMaxNVBuffer{
-			Buffer: data,
-		},
-		Offset: 0,
-	}
-	if _, err := write.Execute(thetpm); err != nil {
-		return fmt.Errorf("calling TPM2_NV_Write: %v", err)
+	// Write the new data to the NV index, in chunks if larger than the TPM
+	// accepts in a single command
+	for offset := 0; offset < len(data); offset += int(bufferMax) {
+		chunk := data[offset:min(offset+int(bufferMax), len(data))]
+		write := tpm2.NVWrite{
+			AuthHandle: tpm2.TPMRHOwner,
+			NVIndex: tpm2.NamedHandle{
+				Handle: nv,
+				Name:   *nvName,
+			},
+			Data: tpm2.TPM2BMaxNVBuffer{
+				Buffer: chunk,
+			},
+			Offset: uint16(offset),
+		}
+		if _, err := write.Execute(thetpm); err != nil {
+			return fmt.Errorf("calling TPM2_NV_Write: %v", err)
+		}
 	}
 	return nil
 }
+
+// tpmProperty returns the value of a fixed TPM property.
+func tpmProperty(thetpm transport.TPM, property tpm2.TPMPT) (uint32, error) {
+	rsp, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapTPMProperties,
+		Property:      uint32(property),
+		PropertyCount: 1,
+	}.Execute(thetpm)
+	if err != nil {
+		return 0, fmt.Errorf("calling TPM2_GetCapability: %v", err)
+	}
+	props, err := rsp.CapabilityData.Data.TPMProperties()
+	if err != nil {
+		return 0, err
+	}
+	if len(props.TPMProperty) == 0 || props.TPMProperty[0].Property != property {
+		return 0, fmt.Errorf("TPM property %#x not reported", uint32(property))
+	}
+	return props.TPMProperty[0].Value, nil
+}
+
+// NV indices of the EK certificates provisioned by the TPM manufacturer, as
+// defined by the TCG EK Credential Profile.
+const (
+	RSAEKCertNVIndex = 0x01C00002
+	ECCEKCertNVIndex = 0x01C0000A
+)
+
+// nvReadChunkSize is well below the minimum TPM2_PT_NV_BUFFER_MAX, so that
+// indices larger than a single read, such as EK certificates, can be read.
+const nvReadChunkSize = 512
+
+// TpmReadEKCert reads the DER encoded EK certificate from the TPM, trying the
+// RSA EK certificate index before the ECC one.
+func TpmReadEKCert(thetpm transport.TPM) ([]byte, error) {
+	var errs []error
+	for _, nv := range []tpm2.TPMHandle{RSAEKCertNVIndex, ECCEKCertNVIndex} {
+		cert, err := tpmNVReadChunked(thetpm, nv, nv)
+		if err == nil {
+			return cert, nil
+		}
+		errs = append(errs, fmt.Errorf("index %#x: %w", uint32(nv), err))
+	}
+	return nil, fmt.Errorf("no EK certificate found: %v", errs)
+}
+
+// tpmNVReadChunked reads an NV index in chunks of nvReadChunkSize, authorized
+// by auth, which is either the owner or the index itself (empty auth).
+func tpmNVReadChunked(thetpm transport.TPM, auth, nv tpm2.TPMHandle) ([]byte, error) {
+	readPubRsp, err := tpm2.NVReadPublic{NVIndex: nv}.Execute(thetpm)
+	if err != nil {
+		return nil, fmt.Errorf("calling TPM2_NV_ReadPublic: %v", err)
+	}
+	nvPublic, err := readPubRsp.NVPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("getting NV public contents: %v", err)
+	}
+	nvName, err := tpm2.NVName(nvPublic)
+	if err != nil {
+		return nil, fmt.Errorf("calculating name of NV index: %v", err)
+	}
+	index := tpm2.NamedHandle{Handle: nv, Name: *nvName}
+
+	data := make([]byte, 0, nvPublic.DataSize)
+	for offset := uint16(0); offset < nvPublic.DataSize; {
+		size := min(nvPublic.DataSize-offset, nvReadChunkSize)
+		read := tpm2.NVRead{
+			AuthHandle: auth,
+			NVIndex:    index,
+			Size:       size,
+			Offset:     offset,
+		}
+		if auth == nv {
+			read.AuthHandle = index
+		}
+		readRsp, err := read.Execute(thetpm)
+		if err != nil {
+			return nil, fmt.Errorf("calling TPM2_NV_Read: %v", err)
+		}
+		data = append(data, readRsp.Data.Buffer...)
+		offset += size
+	}
+	return data, nil
+}
@@ -0,0 +1,33 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build tpmsim
+
+package tpm_utils
+
+import (
+	"fmt"
+
+	"github.com/fido-device-onboard/go-fdo/tpm"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+// simulatorSupported is whether "simulator" may be given as the TPM path.
+const simulatorSupported = true
+
+// TpmOpen opens the TPM at tpmPath. A path of "simulator" starts an
+// in-process TPM simulator. Its state, including NV indices, is held in memory
+// only, so each run starts from a freshly manufactured TPM.
+func TpmOpen(tpmPath string) (tpm.Closer, error) {
+	if err := CheckTpmPath(tpmPath); err != nil {
+		return nil, err
+	}
+	if tpmPath == "simulator" {
+		sim, err := simulator.OpenSimulator()
+		if err != nil {
+			return nil, fmt.Errorf("error starting tpm simulator: %w", err)
+		}
+		return sim, nil
+	}
+	return tpm.Open(tpmPath)
+}